@@ -6,10 +6,6 @@ func FromContext(ctx context.Context) context.Context {
 	return fromContext(ctx, otelContextKey)
 }
 
-func UserContext(ctx context.Context) context.Context {
-	return fromContext(ctx, userContextKey)
-}
-
 func fromContext(ctx context.Context, k string) context.Context {
 	if v := ctx.Value(k); v != nil {
 		return v.(context.Context)
@@ -4,93 +4,138 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"strconv"
-	"time"
 
 	"github.com/getlantern/golog"
-	"github.com/getlantern/telemetry"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/propagation"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	otelContextKey = "otel-ctx"
-	userContextKey = "user-context"
+	tracerName     = "autoupdate-server"
+
+	legacyTraceHeader = "X-Lantern-Trace"
+	userIDHeader      = "X-Lantern-User-Id"
+	requestIDHeader   = "X-Request-Id"
 )
 
 var (
 	log = golog.LoggerFor("autoupdate-server.instrument")
-	//Tracer = trace.NewNoopTracerProvider().Tracer("noop") // no op by default (for tests, dev)
-	Tracer = otel.Tracer("autoupdate-server")
+
+	propagator = propagation.TraceContext{}
 )
 
-type Opts struct {
-	HoneycombSampleRate int
-	ReportingInterval time.Duration
+// NewOTELMiddleware returns a middleware tracing requests with tp, the provider
+// built by otel.BuildTracerProvider, which samples and exports the traces.
+// Requests go through untraced if tp is nil, as when tracing is disabled.
+func NewOTELMiddleware(tp *sdktrace.TracerProvider) func(next http.Handler) http.Handler {
+	if tp == nil {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	log.Debug("Enabling OpenTelemetry trace exporting")
+	tracer := tp.Tracer(tracerName)
+	return func(next http.Handler) http.Handler {
+		return traceRequests(tracer, next)
+	}
 }
 
-func NewOTELMiddleware(tp *sdktrace.TracerProvider) (func(next http.Handler) http.Handler, func() error) {
-	ctx := context.Background()
-	log.Debug("Enabling OpenTelemetry trace exporting")
-	stopTracing := telemetry.EnableOTELTracingWithSampleRate(ctx, 1)
+// Start starts a span as a child of the span in ctx, with the tracer provider
+// of that span. Spans started without a span in ctx, as for requests that
+// aren't traced, are not recorded.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// traceRequests starts a server span with tracer for requests that are part
+// of a trace started by the client, and passes the span down to next through
+// the request context.
+func traceRequests(tracer trace.Tracer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, ok := extract(r.Context(), r.Header)
+		// we only want to trace things that are part of an existing flow
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		spanOptions := []trace.SpanStartOption{
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("autoupdate-server", r.URL.Path, r)...),
+			trace.WithSpanKind(trace.SpanKindServer),
+		}
+		if requestID := r.Header.Get(requestIDHeader); requestID != "" {
+			spanOptions = append(spanOptions, trace.WithAttributes(attribute.String("request.id", requestID)))
+		}
+		// if we know userId, attach it to the span
+		if userID := r.Header.Get(userIDHeader); userID != "" {
+			spanOptions = append(spanOptions, trace.WithAttributes(semconv.EnduserIDKey.String(userID)))
+		}
+
+		ctx, span := tracer.Start(ctx, fmt.Sprintf("%s %s", r.Method, r.URL.Path), spanOptions...)
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(ctx, otelContextKey, ctx)))
 
-	Tracer = tp.Tracer("autoupdate-server")
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(sw.status)...)
+		span.SetAttributes(attribute.Int64("http.response_content_length", sw.written))
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(sw.status, trace.SpanKindServer))
+	})
+}
+
+// extract returns ctx carrying the span context sent by the client, either in
+// W3C traceparent and tracestate headers or, for older clients, as a bare
+// trace ID in X-Lantern-Trace. It reports false if the client sent neither.
+func extract(ctx context.Context, header http.Header) (context.Context, bool) {
+	if remote := propagator.Extract(ctx, propagation.HeaderCarrier(header)); trace.SpanContextFromContext(remote).IsValid() {
+		return remote, true
+	}
+	traceID, err := trace.TraceIDFromHex(header.Get(legacyTraceHeader))
+	if err != nil || !traceID.IsValid() {
+		return ctx, false
+	}
+	// Older clients don't send the ID of their span, so ours joins their trace
+	// without a parent span. It's sampled as a root span.
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		Remote:  true,
+	})
+	return trace.ContextWithRemoteSpanContext(ctx, sc), true
+}
 
+// statusWriter records the status code and the size of the response written
+// by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
 
-	stop := func() error {
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer func() {
-			cancel()
-		}()
-		return stopTracing(ctx)
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
 	}
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			c := r.Context()
-			traceID, err := trace.TraceIDFromHex(Value(c, "X-Lantern-Trace"))
-			// we only want to trace things that are part of an existing flow
-			if err != nil || !traceID.IsValid() {
-				next.ServeHTTP(w, r)
-				return
-			}
-
-			spanOptions := []trace.SpanStartOption{
-				trace.WithAttributes(attribute.String("request.id", Value(c, "requestid"))),
-				trace.WithSpanKind(trace.SpanKindServer),
-			}
-
-			// if we know userId, attach it to the span
-			if userID := Value(c, "X-Lantern-User-Id"); userID != "" {
-				spanOptions = append(spanOptions, trace.WithAttributes(semconv.EnduserIDKey.String(userID)))
-			}
-
-			sc := trace.NewSpanContext(trace.SpanContextConfig{
-				TraceID:    traceID,
-				TraceFlags: 0,
-			})
-
-			ctx := trace.ContextWithRemoteSpanContext(UserContext(c), sc)
-
-			otelCtx, span := Tracer.Start(
-				ctx,
-				fmt.Sprintf("%s %s", r.Method, r.URL.Path),
-				spanOptions...,
-			)
-			context.WithValue(c, otelContextKey, otelCtx)
-			defer span.End()
-
-			statusCode, _ := strconv.Atoi(w.Header().Get("Status"))
-			attrs := semconv.HTTPAttributesFromHTTPStatusCode(statusCode)
-			spanStatus, spanMessage := semconv.SpanStatusFromHTTPStatusCode(statusCode)
-			span.SetAttributes(attrs...)
-			span.SetStatus(spanStatus, spanMessage)
-			if err != nil {
-				span.RecordError(err)
-			}
-			next.ServeHTTP(w, r)
-		})
-	}, stop
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush lets handlers streaming their response flush it.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
@@ -0,0 +1,103 @@
+package instrument
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceRequests(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	var handlerSpan trace.SpanContext
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerSpan = trace.SpanContextFromContext(r.Context())
+		if handlerSpan.IsValid() && FromContext(r.Context()) == nil {
+			t.Error("Expecting the traced context to be available from the request context")
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+	})
+	handler := NewOTELMiddleware(tp)(next)
+	serve := func(header http.Header) *httptest.ResponseRecorder {
+		t.Helper()
+		handlerSpan = trace.SpanContext{}
+		r := httptest.NewRequest(http.MethodPost, "/update/lantern", nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound || w.Body.String() != "not found" {
+			t.Fatalf("Expecting the response of the handler, got %d %q", w.Code, w.Body.String())
+		}
+		return w
+	}
+	lastSpan := func() sdktrace.ReadOnlySpan {
+		t.Helper()
+		spans := recorder.Ended()
+		if len(spans) == 0 {
+			t.Fatal("Expecting a span")
+		}
+		return spans[len(spans)-1]
+	}
+
+	serve(nil)
+	if len(recorder.Ended()) != 0 || handlerSpan.IsValid() {
+		t.Fatal("Expecting requests without trace context not to be traced")
+	}
+
+	serve(http.Header{
+		"Traceparent":       {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		"X-Lantern-User-Id": {"1234"},
+		"X-Request-Id":      {"abc"},
+	})
+	span := lastSpan()
+	if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expecting the trace of the client to be joined, got %v", span.SpanContext().TraceID())
+	}
+	if !span.Parent().IsRemote() || span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("Expecting the span of the client as parent, got %v", span.Parent().SpanID())
+	}
+	if span.SpanKind() != trace.SpanKindServer || span.Name() != "POST /update/lantern" {
+		t.Errorf("Unexpected span %s of kind %v", span.Name(), span.SpanKind())
+	}
+	if handlerSpan.SpanID() != span.SpanContext().SpanID() {
+		t.Error("Expecting the handler to get the span of the request in its context")
+	}
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	for key, expected := range map[attribute.Key]string{
+		"http.status_code":             "404",
+		"http.response_content_length": "9",
+		"enduser.id":                   "1234",
+		"request.id":                   "abc",
+		"http.method":                  "POST",
+	} {
+		if v, ok := attrs[key]; !ok || v.Emit() != expected {
+			t.Errorf("Expecting %s to be %s, got %q", key, expected, v.Emit())
+		}
+	}
+	// 4xx are the client's fault, not errors of the server
+	if span.Status().Code == codes.Error {
+		t.Errorf("Expecting a 404 not to fail the server span, got %v", span.Status())
+	}
+
+	serve(http.Header{"X-Lantern-Trace": {"0af7651916cd43dd8448eb211c80319c"}})
+	span = lastSpan()
+	if span.SpanContext().TraceID().String() != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("Expecting the legacy trace to be joined, got %v", span.SpanContext().TraceID())
+	}
+	if !handlerSpan.IsValid() || handlerSpan.TraceID() != span.SpanContext().TraceID() {
+		t.Error("Expecting the handler to get the span of the request in its context")
+	}
+}
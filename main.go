@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/getlantern/autoupdate-server/instrument"
 	"github.com/getlantern/autoupdate-server/otel"
@@ -13,16 +18,38 @@ import (
 
 const (
 	localPatchesDirectory = "./patches/"
+
+	honeycombEndpoint = "api.honeycomb.io:443"
+	honeycombHeader   = "x-honeycomb-team"
 )
 
 var (
-	flagRateLimit          = flag.Int("r", 0, "Rate limit. How many updates are allowed to process per second. Defaults to no limit.")
+	flagRateLimit          = flag.Int("r", 0, "Rate limit. How many updates are allowed to process per second for each app, unless its settings set a rate limit. Defaults to no limit.")
 	flagPrivateKey         = flag.String("k", "", "Path to private key.")
 	flagLocalAddr          = flag.String("l", ":9999", "Local bind address.")
 	flagPublicAddr         = flag.String("p", "http://127.0.0.1:9999/", "Public address.")
 	flagGithubOrganization = flag.String("o", "getlantern", "Github organization. For back compatibility to old clients hitting /update endpoint.")
 	flagGithubProject      = flag.String("n", "lantern", "Github project name. For back compatibility to old clients hitting /update endpoint.")
 	flagRepos              = flag.String("repos", "lantern:getlantern/lantern", "Comma separated mapping of update path to Github repos mapping. The format looks like this 'app1:owner1/repo1,app2:owner2/repo2'")
+	flagPatchStorage       = flag.String("patch-storage", "local", "Where to publish patches, either 'local' to serve them from this server or 's3' to upload them to an S3-compatible bucket. S3 credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.")
+	flagS3Endpoint         = flag.String("s3-endpoint", "https://s3.amazonaws.com", "S3 API endpoint.")
+	flagS3Region           = flag.String("s3-region", "us-east-1", "S3 region.")
+	flagS3Bucket           = flag.String("s3-bucket", "", "S3 bucket to upload patches to.")
+	flagS3Prefix           = flag.String("s3-prefix", "patches/", "Prefix of the S3 keys of uploaded patches.")
+	flagS3PathStyle        = flag.Bool("s3-path-style", false, "Use path-style S3 URLs, as required by most S3-compatible services.")
+	flagPatchBaseURL       = flag.String("patch-base-url", "", "Base URL of the CDN serving the S3 bucket. Clients get presigned S3 URLs if empty.")
+	flagGeoIPDB            = flag.String("geoip-db", "", "Path to a CSV file mapping IP ranges to countries and ISPs, used to locate clients that don't send their country or ISP.")
+	flagTrustedProxies     = flag.String("trusted-proxies", "", "Comma separated addresses or networks in CIDR notation of the proxies in front of the server. Clients are only located by the X-Forwarded-For header of requests coming from them.")
+	flagConfig             = flag.String("config", "", "Path to a YAML or JSON configuration file of the server and its apps, replacing the other flags except -o and -n. It's reloaded on SIGHUP and when it changes.")
+	flagAdminAddr          = flag.String("admin-addr", "", "Local bind address of the admin API, disabled if empty. Requests must carry the token in AUTOUPDATE_ADMIN_TOKEN as a bearer token.")
+	flagCatalogMaxAge      = flag.Duration("catalog-max-age", 90*time.Minute, "How old the releases of an app can get, when refreshes fail, before /readyz reports the server as degraded.")
+	flagShutdownTimeout    = flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait on SIGTERM for the requests being handled to complete before closing their connections.")
+	flagTraceDisabled      = flag.Bool("trace-disabled", false, "Disables tracing.")
+	flagTraceEndpoint      = flag.String("trace-endpoint", honeycombEndpoint, "host:port of the OpenTelemetry collector traces are exported to. Traces sent to Honeycomb carry the API key in HONEYCOMB_API_KEY.")
+	flagTraceProtocol      = flag.String("trace-protocol", "http", "Protocol traces are exported with, either 'http' or 'grpc'.")
+	flagTraceInsecure      = flag.Bool("trace-insecure", false, "Exports traces without TLS, like to a local collector.")
+	flagTraceHeaders       = flag.String("trace-headers", "", "Comma separated headers sent along with traces, in 'name=value' format.")
+	flagTraceSampleRatio   = flag.Float64("trace-sample-ratio", 1, "Fraction of the traces kept, from 0 to 1. Traces the client sampled are always kept.")
 	flagHelp               = flag.Bool("h", false, "Shows help.")
 )
 
@@ -35,43 +62,172 @@ func main() {
 	// Parsing flags
 	flag.Parse()
 
-	if *flagHelp || *flagPrivateKey == "" {
+	if *flagHelp || (*flagPrivateKey == "" && *flagConfig == "") {
 		flag.Usage()
 		os.Exit(0)
 	}
 
-	server.SetPrivateKey(*flagPrivateKey)
+	var cfg *server.Config
+	if *flagConfig != "" {
+		var err error
+		if cfg, err = server.LoadConfig(*flagConfig); err != nil {
+			log.Fatal(err)
+		}
+		if cfg.PublicAddr == "" {
+			cfg.PublicAddr = *flagPublicAddr
+		}
+		if cfg.LocalAddr == "" {
+			cfg.LocalAddr = *flagLocalAddr
+		}
+		if cfg.PrivateKey == "" {
+			cfg.PrivateKey = *flagPrivateKey
+		}
+	} else {
+		cfg = configFromFlags()
+	}
+
+	if cfg.PrivateKey == "" {
+		log.Fatalf("A private key is required")
+	}
+	server.SetPrivateKey(cfg.PrivateKey)
 
-	tp, stop := otel.BuildTracerProvider(&otel.Opts{
-		Endpoint:     "api.honeycomb.io:443",
-		Headers:       map[string]string{
-			"x-honeycomb-team": os.Getenv("HONEYCOMB_API_KEY"),
-		},
-	})
+	tracing := tracingOpts(&cfg.Tracing)
+	tp, stop := otel.BuildTracerProvider(tracing)
 	defer stop()
 
-	otelHandler, stopTracing := instrument.NewOTELMiddleware(tp)
-	defer stopTracing()
+	otelHandler := instrument.NewOTELMiddleware(tp)
+
+	updateServer := server.NewUpdateServer(cfg.PublicAddr, cfg.LocalAddr, localPatchesDirectory, 0)
+	updateServer.SetMiddleware(otelHandler)
+	updateServer.SetCatalogMaxAge(*flagCatalogMaxAge)
+	// The releases of the apps are fetched in the background, so that the
+	// server listens right away and answers /healthz while they are.
+	if err := updateServer.ApplyInitialConfig(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := cfg.Apps[""]; !ok {
+		// back compatibility
+		updateServer.HandleRepo("", *flagGithubOrganization, *flagGithubProject, otelHandler)
+	}
+
+	if *flagConfig != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go updateServer.WatchConfig(*flagConfig, reload)
+	}
+
+	if *flagAdminAddr != "" {
+		token := os.Getenv("AUTOUPDATE_ADMIN_TOKEN")
+		if token == "" {
+			log.Fatalf("AUTOUPDATE_ADMIN_TOKEN is required to serve the admin API")
+		}
+		go func() {
+			if err := updateServer.ListenAndServeAdmin(*flagAdminAddr, token); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Admin ListenAndServe: %v", err)
+			}
+		}()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		terminate := make(chan os.Signal, 1)
+		signal.Notify(terminate, syscall.SIGTERM, os.Interrupt)
+		sig := <-terminate
+		log.Debugf("Got %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *flagShutdownTimeout)
+		defer cancel()
+		if err := updateServer.Shutdown(ctx); err != nil {
+			log.Errorf("Could not shut down gracefully: %v", err)
+		}
+		close(stopped)
+	}()
+
+	if err := updateServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("ListenAndServe: %v", err)
+	}
+	// Wait for the requests being handled to complete before flushing
+	// telemetry.
+	<-stopped
+}
+
+// configFromFlags builds the configuration of the server from the command line
+// flags.
+func configFromFlags() *server.Config {
+	cfg := &server.Config{
+		PublicAddr: *flagPublicAddr,
+		LocalAddr:  *flagLocalAddr,
+		PrivateKey: *flagPrivateKey,
+		RateLimit:  server.RateLimit{UpdatesPerSecond: float64(*flagRateLimit)},
+		Storage: server.StorageConfig{
+			Type:      *flagPatchStorage,
+			Endpoint:  *flagS3Endpoint,
+			Region:    *flagS3Region,
+			Bucket:    *flagS3Bucket,
+			Prefix:    *flagS3Prefix,
+			PathStyle: *flagS3PathStyle,
+			PublicURL: *flagPatchBaseURL,
+		},
+		GeoIPDB: *flagGeoIPDB,
+		Tracing: server.TracingConfig{
+			Disabled:    *flagTraceDisabled,
+			Endpoint:    *flagTraceEndpoint,
+			Protocol:    *flagTraceProtocol,
+			Insecure:    *flagTraceInsecure,
+			Headers:     make(map[string]string),
+			SampleRatio: flagTraceSampleRatio,
+		},
+		Apps: make(map[string]*server.App),
+	}
+	if *flagTrustedProxies != "" {
+		cfg.TrustedProxies = strings.Split(*flagTrustedProxies, ",")
+	}
+	if *flagTraceHeaders != "" {
+		for _, header := range strings.Split(*flagTraceHeaders, ",") {
+			name, value, ok := strings.Cut(header, "=")
+			if !ok {
+				log.Fatalf("expect trace header in 'name=value' format, got '%s'", header)
+			}
+			cfg.Tracing.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
 
-	updateServer := server.NewUpdateServer(*flagPublicAddr, *flagLocalAddr, localPatchesDirectory, *flagRateLimit)
 	for _, mapping := range strings.Split(*flagRepos, ",") {
-		fatal := func() { log.Fatalf("expect repo string in 'app:owner/repo' format, got '%s'", mapping) }
 		pair := strings.Split(mapping, ":")
-		if len(pair) != 2 {
-			fatal()
-		}
-		app := pair[0]
-		parts := strings.Split(pair[1], "/")
-		if len(parts) != 2 {
-			fatal()
+		if len(pair) != 2 || len(strings.Split(pair[1], "/")) != 2 {
+			log.Fatalf("expect repo string in 'app:owner/repo' format, got '%s'", mapping)
 		}
-		repo := parts[1]
-		updateServer.HandleRepo(app, parts[0], repo, otelHandler)
+		cfg.Apps[pair[0]] = &server.App{Source: pair[1]}
 	}
-	// back compatibility
-	updateServer.HandleRepo("", *flagGithubOrganization, *flagGithubProject, otelHandler)
 
-	if err := updateServer.ListenAndServe(); err != nil {
-		log.Fatalf("ListenAndServe: ", err)
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	return cfg
+}
+
+// tracingOpts returns the settings of the trace exporter. Traces go to
+// Honeycomb unless another endpoint is set, with the API key in
+// HONEYCOMB_API_KEY unless the header is set.
+func tracingOpts(t *server.TracingConfig) *otel.Opts {
+	opts := &otel.Opts{
+		Disabled:    t.Disabled,
+		Endpoint:    t.Endpoint,
+		Protocol:    t.Protocol,
+		Insecure:    t.Insecure,
+		Headers:     make(map[string]string),
+		SampleRatio: 1,
+	}
+	for name, value := range t.Headers {
+		opts.Headers[name] = value
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = honeycombEndpoint
+	}
+	if _, ok := opts.Headers[honeycombHeader]; !ok && opts.Endpoint == honeycombEndpoint {
+		opts.Headers[honeycombHeader] = os.Getenv("HONEYCOMB_API_KEY")
+	}
+	if t.SampleRatio != nil {
+		opts.SampleRatio = *t.SampleRatio
 	}
+	return opts
 }
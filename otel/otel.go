@@ -2,10 +2,12 @@ package otel
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
@@ -23,25 +25,78 @@ const (
 	maxQueueSize = 10000
 )
 
+// Protocols traces can be exported with.
+const (
+	PROTOCOL_HTTP = "http"
+	PROTOCOL_GRPC = "grpc"
+)
+
 type Opts struct {
-	Endpoint          string
-	Headers           map[string]string
-	ReportingInterval time.Duration
+	// Disabled turns tracing off, BuildTracerProvider returns no provider.
+	Disabled bool
+	// Endpoint is the host:port of the OTLP collector.
+	Endpoint string
+	// Protocol is PROTOCOL_HTTP, the default, or PROTOCOL_GRPC.
+	Protocol string
+	// Insecure exports traces without TLS, like to a local collector.
+	Insecure bool
+	Headers  map[string]string
+	// SampleRatio is the fraction of traces recorded, from 0 to 1, among
+	// those the client didn't sample. Traces sampled by the client are
+	// always recorded.
+	SampleRatio float64
 }
 
+// newClient returns a client exporting traces to the collector with the
+// protocol in opts.
+func newClient(opts *Opts) (otlptrace.Client, error) {
+	switch opts.Protocol {
+	case "", PROTOCOL_HTTP:
+		options := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(opts.Endpoint),
+			otlptracehttp.WithHeaders(opts.Headers),
+		}
+		if opts.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.NewClient(options...), nil
+	case PROTOCOL_GRPC:
+		options := []otlptracegrpc.Option{
+			otlptracegrpc.WithEndpoint(opts.Endpoint),
+			otlptracegrpc.WithHeaders(opts.Headers),
+		}
+		if opts.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.NewClient(options...), nil
+	}
+	return nil, fmt.Errorf("unknown protocol %q", opts.Protocol)
+}
+
+// BuildTracerProvider returns a provider exporting traces as set in opts, and
+// a function flushing and stopping it. The provider is nil if tracing is
+// disabled or can't be set up.
 func BuildTracerProvider(opts *Opts) (*sdktrace.TracerProvider, func()) {
-	// Create HTTP client to talk to OTEL collector
-	client := otlptracehttp.NewClient(
-		otlptracehttp.WithEndpoint(opts.Endpoint),
-		otlptracehttp.WithHeaders(opts.Headers),
-	)
+	if opts.Disabled {
+		log.Debug("Tracing is disabled")
+		return nil, func() {}
+	}
+	client, err := newClient(opts)
+	if err != nil {
+		log.Errorf("Unable to initialize OpenTelemetry, will not report traces to %v: %v", opts.Endpoint, err)
+		return nil, func() {}
+	}
 	// Create an exporter that exports to the OTEL collector
 	exporter, err := otlptrace.New(context.Background(), client)
 	if err != nil {
 		log.Errorf("Unable to initialize OpenTelemetry, will not report traces to %v", opts.Endpoint)
 		return nil, func() {}
 	}
-	log.Debugf("Will report traces to OpenTelemetry at %v", opts.Endpoint)
+	log.Debugf("Will report %v of traces to OpenTelemetry at %v over %v", opts.SampleRatio, opts.Endpoint, opts.Protocol)
+
+	// Clients that only send a trace ID leave the decision to sample to the
+	// server.
+	sampler := sdktrace.TraceIDRatioBased(opts.SampleRatio)
 
 	// Create a TracerProvider that uses the above exporter
 	attributes := []attribute.KeyValue{
@@ -55,6 +110,7 @@ func BuildTracerProvider(opts *Opts) (*sdktrace.TracerProvider, func()) {
 			sdktrace.WithMaxQueueSize(maxQueueSize),
 		),
 		sdktrace.WithResource(resource),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler, sdktrace.WithRemoteParentNotSampled(sampler))),
 	)
 
 	stop := func() {
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CatalogAsset describes an update asset known to a release manager.
+type CatalogAsset struct {
+	OS         string      `json:"os"`
+	Arch       string      `json:"arch"`
+	Version    string      `json:"version"`
+	Name       string      `json:"name"`
+	URL        string      `json:"url"`
+	LocalFile  string      `json:"local_file"`
+	Checksum   string      `json:"checksum"`
+	Signature  string      `json:"signature"`
+	Format     AssetFormat `json:"format"`
+	Prerelease bool        `json:"prerelease"`
+}
+
+// Catalog is a snapshot of the releases known to a release manager.
+type Catalog struct {
+	Owner       string    `json:"owner"`
+	Repo        string    `json:"repo"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+	// Assets of all releases, newest first for each OS and arch.
+	Assets []CatalogAsset `json:"assets"`
+	// Latest versions by channel, OS and arch.
+	Latest map[string]map[string]map[string]string `json:"latest"`
+}
+
+func catalogAsset(a *Asset) CatalogAsset {
+	return CatalogAsset{
+		OS:         a.OS,
+		Arch:       a.Arch,
+		Version:    a.v.String(),
+		Name:       a.Name,
+		URL:        a.URL,
+		LocalFile:  a.LocalFile,
+		Checksum:   a.Checksum,
+		Signature:  a.Signature,
+		Format:     a.Format,
+		Prerelease: a.Prerelease,
+	}
+}
+
+// Catalog returns a snapshot of the releases known to the release manager.
+func (g *ReleaseManager) Catalog() *Catalog {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	c := &Catalog{
+		Owner:       g.owner,
+		Repo:        g.repo,
+		RefreshedAt: g.refreshedAt,
+		Assets:      []CatalogAsset{},
+		Latest:      make(map[string]map[string]map[string]string),
+	}
+
+	var assets []*Asset
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
+			for _, a := range g.updateAssetsMap[os][arch] {
+				assets = append(assets, a)
+			}
+		}
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		a, b := assets[i], assets[j]
+		if a.OS != b.OS {
+			return a.OS < b.OS
+		}
+		if a.Arch != b.Arch {
+			return a.Arch < b.Arch
+		}
+		return a.v.GT(b.v)
+	})
+	for _, a := range assets {
+		c.Assets = append(c.Assets, catalogAsset(a))
+	}
+
+	latest := func(latestAssetsMap map[string]map[string]*Asset) map[string]map[string]string {
+		versions := make(map[string]map[string]string)
+		for os := range latestAssetsMap {
+			versions[os] = make(map[string]string)
+			for arch, a := range latestAssetsMap[os] {
+				versions[os][arch] = a.v.String()
+			}
+		}
+		return versions
+	}
+	c.Latest[CHANNEL_STABLE] = latest(g.latestAssetsMap)
+	for channel, latestAssetsMap := range g.channelAssetsMap {
+		c.Latest[channel] = latest(latestAssetsMap)
+	}
+
+	return c
+}
+
+// AppPatches returns the metadata of the patches generated for the app, most
+// recently created first.
+func (g *ReleaseManager) AppPatches() []*PatchInfo {
+	patches := []*PatchInfo{}
+	for _, info := range g.patches.List() {
+		if info.App == g.owner+"/"+g.repo {
+			patches = append(patches, info)
+		}
+	}
+	return patches
+}
+
+// adminApp describes an app in the admin API.
+type adminApp struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Owner string `json:"owner"`
+	Repo  string `json:"repo"`
+}
+
+// evaluateRequest is the body of evaluation requests: the params a client
+// would send along with its platform, which clients send in the URL, and
+// optionally its address to locate it.
+type evaluateRequest struct {
+	Params
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	IP   string `json:"ip,omitempty"`
+}
+
+// adminSettings holds the settings of an app in the admin API.
+type adminSettings struct {
+	Config *AppConfig `json:"config"`
+	// RateLimit is the rate limit in effect, either the configured one or
+	// the default one.
+	RateLimit RateLimit `json:"rate_limit"`
+}
+
+// AdminHandler returns the handler of the admin API. Requests must carry the
+// given token as a bearer token. Apps are selected with the app query
+// parameter: the path segment after /update/, or empty for /update itself.
+//
+//	GET    /apps                  lists the apps
+//	PUT    /apps?app=lantern      serves an app or changes its source, once
+//	                              its releases are fetched
+//	DELETE /apps?app=lantern      stops serving an app
+//	GET    /catalog?app=lantern   assets and latest versions
+//	GET    /patches?app=lantern   generated patches
+//	GET    /settings?app=lantern  rollout and rate limit settings
+//	POST   /refresh?app=lantern   looks for new releases right away
+//	POST   /evaluate?app=lantern  traces the update a client would get
+//	POST   /pause?app=lantern&version=7.1.0
+//	                              stops offering a release
+//	POST   /resume?app=lantern&version=7.1.0
+//	                              offers a paused release again
+//	POST   /rollback?app=lantern&version=7.1.0&target=7.0.0
+//	                              sends the clients running a release back to
+//	                              target, or cancels the rollback without one
+func (u *UpdateServer) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apps", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			apps := []adminApp{}
+			for name, rm := range u.releaseManagers() {
+				apps = append(apps, adminApp{Name: name, Path: appPath(name), Owner: rm.owner, Repo: rm.repo})
+			}
+			sort.Slice(apps, func(i, j int) bool {
+				return apps[i].Name < apps[j].Name
+			})
+			writeJSON(w, apps)
+		case http.MethodPut:
+			defer r.Body.Close()
+			name := r.URL.Query().Get("app")
+			app := &App{}
+			if err := json.NewDecoder(r.Body).Decode(app); err != nil {
+				http.Error(w, fmt.Sprintf("JSON decode error: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := app.validate(); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid app %q: %v", name, err), http.StatusBadRequest)
+				return
+			}
+			// Fetching the releases of the app can take minutes, so the
+			// app is served in the background. GET /apps lists it once
+			// it's served.
+			go func() {
+				if err := u.AddApp(name, app); err != nil {
+					log.Errorf("Could not serve app %q: %v", name, err)
+				}
+			}()
+			owner, repo := app.Repo()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			writeJSON(w, adminApp{Name: name, Path: appPath(name), Owner: owner, Repo: repo})
+		case http.MethodDelete:
+			if err := u.RemoveApp(r.URL.Query().Get("app")); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			closeWithStatus(w, http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/catalog", u.adminAppHandler(http.MethodGet, func(w http.ResponseWriter, r *http.Request, rm *ReleaseManager) {
+		writeJSON(w, rm.Catalog())
+	}))
+	mux.HandleFunc("/patches", u.adminAppHandler(http.MethodGet, func(w http.ResponseWriter, r *http.Request, rm *ReleaseManager) {
+		writeJSON(w, rm.AppPatches())
+	}))
+	mux.HandleFunc("/settings", u.adminAppHandler(http.MethodGet, func(w http.ResponseWriter, r *http.Request, rm *ReleaseManager) {
+		writeJSON(w, &adminSettings{Config: rm.Config(), RateLimit: rm.RateLimit()})
+	}))
+	mux.HandleFunc("/refresh", u.adminAppHandler(http.MethodPost, func(w http.ResponseWriter, r *http.Request, rm *ReleaseManager) {
+		if err := rm.UpdateAssetsMap(r.Context()); err != nil {
+			log.Errorf("Could not refresh %s/%s: %v", rm.owner, rm.repo, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, rm.Catalog())
+	}))
+	pause := func(paused bool) http.HandlerFunc {
+		return u.adminAppHandler(http.MethodPost, func(w http.ResponseWriter, r *http.Request, rm *ReleaseManager) {
+			if err := rm.PauseRelease(r.URL.Query().Get("version"), paused); err != nil {
+				http.Error(w, fmt.Sprintf("Bad version: %v", err), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, &adminSettings{Config: rm.Config(), RateLimit: rm.RateLimit()})
+		})
+	}
+	mux.HandleFunc("/pause", pause(true))
+	mux.HandleFunc("/resume", pause(false))
+	mux.HandleFunc("/rollback", u.adminAppHandler(http.MethodPost, func(w http.ResponseWriter, r *http.Request, rm *ReleaseManager) {
+		q := r.URL.Query()
+		if err := rm.SetRollback(q.Get("version"), q.Get("target")); err != nil {
+			http.Error(w, fmt.Sprintf("Bad rollback: %v", err), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, &adminSettings{Config: rm.Config(), RateLimit: rm.RateLimit()})
+	}))
+	mux.HandleFunc("/evaluate", u.adminAppHandler(http.MethodPost, func(w http.ResponseWriter, r *http.Request, rm *ReleaseManager) {
+		defer r.Body.Close()
+		var req evaluateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("JSON decode error: %v", err), http.StatusBadRequest)
+			return
+		}
+		params := req.Params
+		params.OS, params.Arch = req.OS, req.Arch
+		if db := u.geoIP.Load(); req.IP != "" && db != nil {
+			addr, err := netip.ParseAddr(req.IP)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Bad IP address: %v", err), http.StatusBadRequest)
+				return
+			}
+			db.locateAddr(&params, addr)
+		}
+		name := r.URL.Query().Get("app")
+		writeJSON(w, rm.Evaluate(r.Context(), &params, name == "" || name == appLantern))
+	}))
+	return requireToken(token, mux)
+}
+
+// adminAppHandler looks up the app of an admin request before handing it to
+// handle.
+func (u *UpdateServer) adminAppHandler(method string, handle func(w http.ResponseWriter, r *http.Request, rm *ReleaseManager)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			closeWithStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+		rm, ok := u.app(r.URL.Query().Get("app"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		handle(w, r, rm)
+	}
+}
+
+// requireToken rejects requests that don't carry the given bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="autoupdate-server"`)
+			closeWithStatus(w, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Debugf("Unable to write response: %v", err)
+	}
+}
+
+// ListenAndServeAdmin serves the admin API on its own address until the
+// server is shut down or closed.
+func (u *UpdateServer) ListenAndServeAdmin(addr string, token string) error {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: u.AdminHandler(token),
+	}
+	log.Debugf("Starting up admin HTTP server at %s.", addr)
+	return u.listenAndServe(srv)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAPI(t *testing.T) {
+	rm := newTestReleaseManager(t, "7.0.0", "7.1.0")
+	rm.SetConfig(&AppConfig{Rollouts: []Rollout{{Version: "7.1.0", Percentage: 10}}})
+	rm.SetDefaultRateLimit(RateLimit{UpdatesPerSecond: 5})
+
+	u := NewUpdateServer("http://127.0.0.1:9999/", "127.0.0.1:0", ".", 0)
+	u.apps["lantern"] = rm
+	srv := httptest.NewServer(u.AdminHandler("secret"))
+	defer srv.Close()
+
+	request := func(method string, path string, token string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	decode := func(res *http.Response, v any) {
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expecting 200 OK, got %s", res.Status)
+		}
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		res := request(http.MethodGet, "/apps", token)
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expecting 401 with token %q, got %s", token, res.Status)
+		}
+	}
+
+	var apps []adminApp
+	decode(request(http.MethodGet, "/apps", "secret"), &apps)
+	if len(apps) != 1 || apps[0].Path != "/update/lantern" || apps[0].Repo != "lantern" {
+		t.Fatalf("Unexpected apps %+v", apps)
+	}
+
+	var catalog Catalog
+	decode(request(http.MethodGet, "/catalog?app=lantern", "secret"), &catalog)
+	if len(catalog.Assets) != 2 || catalog.Assets[0].Version != "7.1.0" || catalog.Assets[0].Checksum == "" || catalog.Assets[0].LocalFile == "" {
+		t.Fatalf("Unexpected catalog assets %+v", catalog.Assets)
+	}
+	if catalog.Latest[CHANNEL_STABLE][OS.Linux][Arch.X64] != "7.1.0" {
+		t.Fatalf("Unexpected latest versions %+v", catalog.Latest)
+	}
+
+	var settings adminSettings
+	decode(request(http.MethodGet, "/settings?app=lantern", "secret"), &settings)
+	if len(settings.Config.Rollouts) != 1 || settings.RateLimit.UpdatesPerSecond != 5 {
+		t.Fatalf("Unexpected settings %+v", settings)
+	}
+
+	var patches []*PatchInfo
+	decode(request(http.MethodGet, "/patches?app=lantern", "secret"), &patches)
+
+	settings = adminSettings{}
+	decode(request(http.MethodPost, "/pause?app=lantern&version=7.1.0", "secret"), &settings)
+	if len(settings.Config.PausedVersions) != 1 || len(settings.Config.Rollouts) != 1 {
+		t.Fatalf("Expecting 7.1.0 to be paused, got %+v", settings.Config)
+	}
+	settings = adminSettings{}
+	decode(request(http.MethodPost, "/resume?app=lantern&version=7.1.0", "secret"), &settings)
+	if len(settings.Config.PausedVersions) != 0 {
+		t.Fatalf("Expecting 7.1.0 to be resumed, got %+v", settings.Config)
+	}
+	settings = adminSettings{}
+	decode(request(http.MethodPost, "/rollback?app=lantern&version=7.1.0&target=7.0.0", "secret"), &settings)
+	if len(settings.Config.Rollbacks) != 1 || settings.Config.Rollbacks[0].Target != "7.0.0" {
+		t.Fatalf("Expecting 7.1.0 to be rolled back, got %+v", settings.Config)
+	}
+	settings = adminSettings{}
+	decode(request(http.MethodPost, "/rollback?app=lantern&version=7.1.0", "secret"), &settings)
+	if len(settings.Config.Rollbacks) != 0 {
+		t.Fatalf("Expecting the rollback to be cancelled, got %+v", settings.Config)
+	}
+	for _, path := range []string{"/pause?app=lantern&version=latest", "/rollback?app=lantern&version=7.0.0&target=7.1.0"} {
+		res := request(http.MethodPost, path, "secret")
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expecting 400 for %s, got %s", path, res.Status)
+		}
+	}
+
+	res := request(http.MethodGet, "/catalog?app=beam", "secret")
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expecting 404 for unknown app, got %s", res.Status)
+	}
+	res = request(http.MethodGet, "/refresh?app=lantern", "secret")
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expecting refreshes to require POST, got %s", res.Status)
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// appPath returns the HTTP path of the app served under the given name.
+func appPath(name string) string {
+	if name == "" {
+		return httpPathPrefix
+	}
+	return httpPathPrefix + "/" + name
+}
+
+// appsHandler dispatches update requests to the handler of their app.
+func (u *UpdateServer) appsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := ""
+		if r.URL.Path != httpPathPrefix {
+			var ok bool
+			name, ok = strings.CutPrefix(r.URL.Path, httpPathPrefix+"/")
+			if !ok || name == "" {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		u.mu.RLock()
+		handler, ok := u.handlers[name]
+		if ok {
+			// Counted while holding the lock so that the release manager
+			// cannot be retired before the request is accounted for.
+			releaseManager := u.apps[name]
+			releaseManager.requests.Add(1)
+			defer releaseManager.requests.Done()
+		}
+		u.mu.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// AddApp serves the given app under /update/<name>, or /update if name is
+// empty. The app replaces the one served under the same name, if any, once
+// its releases are fetched. Requests being handled by the replaced app are
+// not interrupted.
+func (u *UpdateServer) AddApp(name string, app *App) error {
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("app name %q must not contain slashes", name)
+	}
+	if err := app.validate(); err != nil {
+		return err
+	}
+	owner, repo := app.Repo()
+	if err := u.serve(name, owner, repo, &app.AppConfig); err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.appConfigs[name] = &app.AppConfig
+	u.mu.Unlock()
+	return nil
+}
+
+// preparedApp is an app whose releases are fetched, ready to be served.
+type preparedApp struct {
+	releaseManager *ReleaseManager
+	handler        http.Handler
+}
+
+// newApp creates the release manager and handler of the app to be served
+// under the given name, without fetching its releases.
+func (u *UpdateServer) newApp(name string, owner string, repo string, cfg *AppConfig, storage PatchStorage, rateLimit RateLimit) *preparedApp {
+	releaseManager := u.newReleaseManager(owner, repo)
+	releaseManager.SetPatchStorage(storage)
+	releaseManager.SetConfig(cfg)
+	releaseManager.SetPublicAddr(u.publicAddr)
+	releaseManager.SetDefaultRateLimit(rateLimit)
+
+	handler := u.handlerFor(name, releaseManager)
+	if u.middleware != nil {
+		handler = u.middleware(handler)
+	}
+	return &preparedApp{releaseManager: releaseManager, handler: handler}
+}
+
+// prepare fetches the releases of the given repo for the app to be served
+// under the given name, without serving it yet.
+func (u *UpdateServer) prepare(name string, owner string, repo string, cfg *AppConfig, storage PatchStorage, rateLimit RateLimit) (*preparedApp, error) {
+	app := u.newApp(name, owner, repo, cfg, storage, rateLimit)
+	// Getting assets...
+	if err := app.releaseManager.UpdateAssetsMap(context.Background()); err != nil {
+		app.releaseManager.Stop()
+		return nil, fmt.Errorf("Could not get releases of %s/%s: %v", owner, repo, err)
+	}
+	return app, nil
+}
+
+// install serves a prepared app under the given name, in place of the app
+// served under that name if any. u.mu must be held.
+func (u *UpdateServer) install(name string, app *preparedApp) {
+	if previous, ok := u.stops[name]; ok {
+		close(previous)
+	}
+	if previous, ok := u.apps[name]; ok {
+		u.retire(previous)
+	}
+	stop := make(chan struct{})
+	u.apps[name] = app.releaseManager
+	u.handlers[name] = app.handler
+	u.stops[name] = stop
+	// Setting a goroutine for pulling updates periodically
+	u.refreshes.Add(1)
+	go u.backgroundUpdate(app.releaseManager, stop)
+	log.Debugf("HTTP path %q maps to repo %s/%s", appPath(name), app.releaseManager.owner, app.releaseManager.repo)
+}
+
+// serve starts serving the releases of the given repo under the given name,
+// once they are fetched.
+func (u *UpdateServer) serve(name string, owner string, repo string, cfg *AppConfig) error {
+	u.mu.RLock()
+	storage, rateLimit := u.patchStorage, u.rateLimit
+	u.mu.RUnlock()
+
+	app, err := u.prepare(name, owner, repo, cfg, storage, rateLimit)
+	if err != nil {
+		return err
+	}
+	return u.installApp(name, app)
+}
+
+// installApp serves a prepared app under the given name unless the server is
+// shutting down.
+func (u *UpdateServer) installApp(name string, app *preparedApp) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closing {
+		app.releaseManager.Stop()
+		return fmt.Errorf("the server is shutting down")
+	}
+	u.install(name, app)
+	return nil
+}
+
+// RemoveApp stops serving the app with the given name. Requests being handled
+// are not interrupted.
+func (u *UpdateServer) RemoveApp(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.removeApp(name)
+}
+
+// removeApp stops serving the app with the given name. u.mu must be held.
+func (u *UpdateServer) removeApp(name string) error {
+	releaseManager, ok := u.apps[name]
+	if !ok {
+		return fmt.Errorf("no app %q", name)
+	}
+	if stop, ok := u.stops[name]; ok {
+		close(stop)
+	}
+	u.retire(releaseManager)
+	delete(u.apps, name)
+	delete(u.handlers, name)
+	delete(u.stops, name)
+	delete(u.appConfigs, name)
+	log.Debugf("HTTP path %q of repo %s/%s is not served anymore", appPath(name), releaseManager.owner, releaseManager.repo)
+	return nil
+}
+
+// retire stops the given release manager, which no longer serves any app,
+// once the requests it is handling complete. Shutdown and Close stop it right
+// away. u.mu must be held.
+func (u *UpdateServer) retire(releaseManager *ReleaseManager) {
+	u.retired[releaseManager] = struct{}{}
+	go func() {
+		releaseManager.requests.Wait()
+		releaseManager.Stop()
+		u.mu.Lock()
+		delete(u.retired, releaseManager)
+		u.mu.Unlock()
+	}()
+}
+
+// app returns the release manager of the app served under the given name.
+func (u *UpdateServer) app(name string) (*ReleaseManager, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	releaseManager, ok := u.apps[name]
+	return releaseManager, ok
+}
+
+// releaseManagers returns the release managers of the apps being served,
+// keyed by name.
+func (u *UpdateServer) releaseManagers() map[string]*ReleaseManager {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	releaseManagers := make(map[string]*ReleaseManager, len(u.apps))
+	for name, releaseManager := range u.apps {
+		releaseManagers[name] = releaseManager
+	}
+	return releaseManagers
+}
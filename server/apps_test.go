@@ -0,0 +1,264 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestReleaseManagers returns a constructor of release managers pulling
+// releases from a Github API stand-in without any release.
+func newTestReleaseManagers(t *testing.T) func(owner string, repo string) *ReleaseManager {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/repos/broken/") {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("[]"))
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, _ := url.Parse(srv.URL + "/")
+	return func(owner string, repo string) *ReleaseManager {
+		rm := NewReleaseManager(owner, repo)
+		rm.client.BaseURL = baseURL
+		return rm
+	}
+}
+
+func TestAddAndRemoveApps(t *testing.T) {
+	u := NewUpdateServer("http://127.0.0.1:9999/", "127.0.0.1:0", ".", 0)
+	u.newReleaseManager = newTestReleaseManagers(t)
+	defer u.Close()
+
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		u.mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader("{")))
+		return w.Code
+	}
+
+	if err := u.AddApp("beam", &App{Source: "xiaoshoudian/xiazai"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.AddApp("lantern", &App{Source: "getlantern/lantern", AppConfig: AppConfig{MinVersion: "6.0.0"}}); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]int{
+		"/update/beam":       http.StatusBadRequest,
+		"/update/lantern":    http.StatusBadRequest,
+		"/update":            http.StatusNotFound,
+		"/update/":           http.StatusNotFound,
+		"/update/other":      http.StatusNotFound,
+		"/update/beam/other": http.StatusNotFound,
+	} {
+		if got := status(path); got != expected {
+			t.Errorf("Expecting %d for %s, got %d", expected, path, got)
+		}
+	}
+
+	// Repointing an app replaces its release manager and stops the previous
+	// one.
+	stop := u.stops["beam"]
+	if err := u.AddApp("beam", &App{Source: "getlantern/beam"}); err != nil {
+		t.Fatal(err)
+	}
+	if rm, _ := u.app("beam"); rm.owner != "getlantern" || rm.repo != "beam" {
+		t.Fatalf("Expecting beam to be repointed, got %s/%s", rm.owner, rm.repo)
+	}
+	select {
+	case <-stop:
+	default:
+		t.Fatal("The previous release manager of beam should be stopped")
+	}
+
+	stop = u.stops["beam"]
+	if err := u.RemoveApp("beam"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stop:
+	default:
+		t.Fatal("The release manager of beam should be stopped")
+	}
+	if got := status("/update/beam"); got != http.StatusNotFound {
+		t.Fatalf("Expecting removed app to be gone, got %d", got)
+	}
+	if err := u.RemoveApp("beam"); err == nil {
+		t.Fatal("Removing an unknown app should fail")
+	}
+
+	for name, app := range map[string]*App{
+		"a/b":     {Source: "getlantern/lantern"},
+		"nosrc":   {Source: "lantern"},
+		"badcfg":  {Source: "getlantern/lantern", AppConfig: AppConfig{MinVersion: "six"}},
+		"lantern": {Source: "getlantern"},
+	} {
+		if err := u.AddApp(name, app); err == nil {
+			t.Errorf("Expecting app %q to be rejected", name)
+		}
+	}
+	if rm, _ := u.app("lantern"); rm.Config().MinVersion != "6.0.0" {
+		t.Fatal("Rejected apps should not replace served ones")
+	}
+
+	// Config reloads sync the apps served.
+	err := u.ApplyConfig(&Config{Apps: map[string]*App{
+		"lantern": {Source: "getlantern/lantern", AppConfig: AppConfig{MinVersion: "6.1.0"}},
+		"":        {Source: "getlantern/lantern"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := status("/update"); got != http.StatusBadRequest {
+		t.Fatalf("Expecting /update to be served, got %d", got)
+	}
+	if rm, _ := u.app("lantern"); rm.Config().MinVersion != "6.1.0" {
+		t.Fatal("Expecting the settings of lantern to be updated")
+	}
+
+	// Reloads that fail leave the server untouched.
+	err = u.ApplyConfig(&Config{RateLimit: RateLimit{UpdatesPerSecond: 5}, Apps: map[string]*App{
+		"lantern": {Source: "getlantern/lantern", AppConfig: AppConfig{MinVersion: "7.0.0"}},
+		"broken":  {Source: "broken/repo"},
+	}})
+	if err == nil {
+		t.Fatal("Expecting apps whose releases can't be fetched to fail the reload")
+	}
+	if rm, _ := u.app("lantern"); rm.Config().MinVersion != "6.1.0" || rm.RateLimit().UpdatesPerSecond == 5 {
+		t.Fatalf("Expecting the settings of lantern to be kept, got %+v", rm.Config())
+	}
+	if _, ok := u.app("broken"); ok {
+		t.Fatal("Expecting the broken app not to be served")
+	}
+
+	if err = u.ApplyConfig(&Config{Apps: map[string]*App{}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := u.app("lantern"); ok {
+		t.Fatal("Expecting lantern to be removed")
+	}
+	if _, ok := u.app(""); !ok {
+		t.Fatal("/update should be kept")
+	}
+}
+
+func TestRetireReleaseManagers(t *testing.T) {
+	u := NewUpdateServer("http://127.0.0.1:9999/", "127.0.0.1:0", ".", 0)
+	u.newReleaseManager = newTestReleaseManagers(t)
+	defer u.Close()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	u.middleware = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("block") != "" {
+				close(started)
+				<-release
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	stopped := func(rm *ReleaseManager) bool {
+		select {
+		case <-rm.ctx.Done():
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+
+	if err := u.AddApp("beam", &App{Source: "xiaoshoudian/xiazai"}); err != nil {
+		t.Fatal(err)
+	}
+	replaced, _ := u.app("beam")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		u.mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/update/beam?block=1", strings.NewReader("{")))
+	}()
+	<-started
+
+	if err := u.AddApp("beam", &App{Source: "getlantern/beam"}); err != nil {
+		t.Fatal(err)
+	}
+	if replaced.ctx.Err() != nil {
+		t.Fatal("A replaced release manager should not be stopped while handling requests")
+	}
+	close(release)
+	<-done
+	if !stopped(replaced) {
+		t.Fatal("Expecting the replaced release manager to be stopped once its requests complete")
+	}
+
+	removed, _ := u.app("beam")
+	if err := u.RemoveApp("beam"); err != nil {
+		t.Fatal(err)
+	}
+	if !stopped(removed) {
+		t.Fatal("Expecting the removed release manager to be stopped")
+	}
+
+	// Retired release managers still handling requests are stopped on close.
+	if err := u.AddApp("lantern", &App{Source: "getlantern/lantern"}); err != nil {
+		t.Fatal(err)
+	}
+	draining, _ := u.app("lantern")
+	draining.requests.Add(1)
+	defer draining.requests.Done()
+	if err := u.RemoveApp("lantern"); err != nil {
+		t.Fatal(err)
+	}
+	u.Close()
+	if draining.ctx.Err() == nil {
+		t.Fatal("Expecting retired release managers to be stopped on close")
+	}
+}
+
+func TestAdminApps(t *testing.T) {
+	u := NewUpdateServer("http://127.0.0.1:9999/", "127.0.0.1:0", ".", 0)
+	u.newReleaseManager = newTestReleaseManagers(t)
+	defer u.Close()
+	srv := httptest.NewServer(u.AdminHandler("secret"))
+	defer srv.Close()
+
+	request := func(method string, path string, body string) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	served := func(name string) *ReleaseManager {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if rm, ok := u.app(name); ok {
+				return rm
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Timed out waiting for %s to be served", name)
+		return nil
+	}
+
+	if got := request(http.MethodPut, "/apps?app=beam", `{"source": "xiaoshoudian/xiazai", "min_version": "1.0.0"}`); got != http.StatusAccepted {
+		t.Fatalf("Expecting beam to be added, got %d", got)
+	}
+	if rm := served("beam"); rm.Config().MinVersion != "1.0.0" {
+		t.Fatal("Expecting beam to be served with its settings")
+	}
+	if got := request(http.MethodPut, "/apps?app=beam", `{"source": "xiazai"}`); got != http.StatusBadRequest {
+		t.Fatalf("Expecting bad source to be rejected, got %d", got)
+	}
+	if got := request(http.MethodDelete, "/apps?app=beam", ""); got != http.StatusNoContent {
+		t.Fatalf("Expecting beam to be removed, got %d", got)
+	}
+	if got := request(http.MethodDelete, "/apps?app=beam", ""); got != http.StatusNotFound {
+		t.Fatalf("Expecting 404 for unknown app, got %d", got)
+	}
+}
@@ -0,0 +1,536 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// AssetFormat describes how the contents of an asset are packaged.
+type AssetFormat string
+
+const (
+	ASSETFORMAT_RAW   AssetFormat = "raw"
+	ASSETFORMAT_BZIP2 AssetFormat = "bzip2"
+	ASSETFORMAT_ZIP   AssetFormat = "zip"
+	ASSETFORMAT_TAR   AssetFormat = "tar"
+)
+
+const (
+	// archivePatchMagic identifies an archive patch container.
+	archivePatchMagic = "AUARCH01"
+
+	archiveOpData  = "data"
+	archiveOpCopy  = "copy"
+	archiveOpPatch = "patch"
+)
+
+// isArchive returns true if assets in this format can be diffed entry by
+// entry.
+func (f AssetFormat) isArchive() bool {
+	return f == ASSETFORMAT_ZIP || f == ASSETFORMAT_TAR
+}
+
+// detectAssetFormat sniffs the contents of a downloaded asset. Since
+// downloadAsset stores .bz2 assets decompressed, the bzip2 layer is
+// transparent here and a .tar.bz2 asset is detected as a tar archive.
+func detectAssetFormat(uri string, localfile string) (AssetFormat, error) {
+	fp, err := os.Open(localfile)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(fp, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	if bytes.HasPrefix(header, []byte("PK\x03\x04")) {
+		return ASSETFORMAT_ZIP, nil
+	}
+	if len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar")) {
+		return ASSETFORMAT_TAR, nil
+	}
+	if path.Ext(uri) == ".bz2" {
+		return ASSETFORMAT_BZIP2, nil
+	}
+	return ASSETFORMAT_RAW, nil
+}
+
+// archiveManifest describes how to rebuild the new version of an archive out
+// of the old one. It is stored at the beginning of an archive patch
+// container, which looks like this:
+//
+//	"AUARCH01" | uint32 big endian manifest length | manifest JSON | blobs
+//
+// The new file is the concatenation of the outputs of all operations, in
+// order.
+type archiveManifest struct {
+	Version  int         `json:"version"`
+	Format   AssetFormat `json:"format"`
+	Size     int64       `json:"size"`     // Size of the rebuilt file.
+	Checksum string      `json:"checksum"` // SHA256 hash of the rebuilt file.
+	Ops      []archiveOp `json:"ops"`
+}
+
+// archiveOp is a single operation of an archive patch.
+//
+//   - data: emits BlobLength bytes from the blob area, verbatim.
+//   - copy: emits Length bytes of the old file starting at Offset.
+//   - patch: takes Length bytes of the old file starting at Offset and applies
+//     the bsdiff patch held in the blob area.
+//
+// Only entries stored uncompressed are patched. Rebuilding compressed entries
+// would require compressing them again into the exact same bytes, which
+// compressors don't guarantee across versions, so changed compressed entries
+// are shipped whole.
+type archiveOp struct {
+	Op         string `json:"op"`
+	Name       string `json:"name,omitempty"` // Name of the archive entry, if any.
+	Offset     int64  `json:"offset,omitempty"`
+	Length     int64  `json:"length,omitempty"`
+	BlobOffset int64  `json:"blob_offset,omitempty"`
+	BlobLength int64  `json:"blob_length,omitempty"`
+}
+
+// archiveEntry locates the stored (possibly compressed) data of a file within
+// an archive.
+type archiveEntry struct {
+	name   string
+	offset int64
+	size   int64
+	method uint16
+}
+
+// archiveEntries lists the entries with data of the given archive, sorted by
+// offset.
+func archiveEntries(file string, format AssetFormat) ([]archiveEntry, error) {
+	var entries []archiveEntry
+
+	switch format {
+	case ASSETFORMAT_ZIP:
+		r, err := zip.OpenReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if f.CompressedSize64 == 0 {
+				continue
+			}
+			offset, err := f.DataOffset()
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, archiveEntry{
+				name:   f.Name,
+				offset: offset,
+				size:   int64(f.CompressedSize64),
+				method: f.Method,
+			})
+		}
+	case ASSETFORMAT_TAR:
+		fp, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		tr := tar.NewReader(fp)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+				continue
+			}
+			// The tar reader does not read ahead, so right after Next() the
+			// file is positioned at the beginning of the entry data.
+			offset, err := fp.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, archiveEntry{
+				name:   hdr.Name,
+				offset: offset,
+				size:   hdr.Size,
+				method: zip.Store,
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported archive format %q", format)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].offset < entries[j].offset
+	})
+	for i := 1; i < len(entries); i++ {
+		if entries[i-1].offset+entries[i-1].size > entries[i].offset {
+			return nil, fmt.Errorf("overlapping archive entries %q and %q", entries[i-1].name, entries[i].name)
+		}
+	}
+	return entries, nil
+}
+
+func readRange(fp *os.File, offset int64, length int64) ([]byte, error) {
+	buf := make([]byte, length)
+	if _, err := fp.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// bsdiffBytes runs bsdiff over two in-memory buffers.
+func bsdiffBytes(ctx context.Context, oldData []byte, newData []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "autoupdate-bsdiff")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	oldfile, newfile, patchfile := dir+"/old", dir+"/new", dir+"/patch"
+	if err = os.WriteFile(oldfile, oldData, 0600); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(newfile, newData, 0600); err != nil {
+		return nil, err
+	}
+	if err = runBsdiff(ctx, oldfile, newfile, patchfile); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(patchfile)
+}
+
+// bspatchBytes runs bspatch over two in-memory buffers.
+func bspatchBytes(oldData []byte, patch []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "autoupdate-bspatch")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	oldfile, newfile, patchfile := dir+"/old", dir+"/new", dir+"/patch"
+	if err = os.WriteFile(oldfile, oldData, 0600); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(patchfile, patch, 0600); err != nil {
+		return nil, err
+	}
+	if err = bspatch(oldfile, newfile, patchfile); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(newfile)
+}
+
+// archiveDiffer accumulates the operations of an archive patch. Blobs are
+// spooled into a temporary file until the container is written.
+type archiveDiffer struct {
+	ops     []archiveOp
+	blobs   *os.File
+	blobLen int64
+	pending []byte
+}
+
+func (d *archiveDiffer) addBlob(b []byte) (int64, error) {
+	offset := d.blobLen
+	if _, err := d.blobs.Write(b); err != nil {
+		return 0, err
+	}
+	d.blobLen += int64(len(b))
+	return offset, nil
+}
+
+// literal queues bytes to be emitted verbatim, contiguous literals are merged
+// into a single operation.
+func (d *archiveDiffer) literal(b []byte) {
+	d.pending = append(d.pending, b...)
+}
+
+func (d *archiveDiffer) flush() error {
+	if len(d.pending) == 0 {
+		return nil
+	}
+	offset, err := d.addBlob(d.pending)
+	if err != nil {
+		return err
+	}
+	d.ops = append(d.ops, archiveOp{
+		Op:         archiveOpData,
+		BlobOffset: offset,
+		BlobLength: int64(len(d.pending)),
+	})
+	d.pending = nil
+	return nil
+}
+
+func (d *archiveDiffer) add(op archiveOp, blob []byte) error {
+	if err := d.flush(); err != nil {
+		return err
+	}
+	if blob != nil {
+		offset, err := d.addBlob(blob)
+		if err != nil {
+			return err
+		}
+		op.BlobOffset, op.BlobLength = offset, int64(len(blob))
+	}
+	d.ops = append(d.ops, op)
+	return nil
+}
+
+// diffEntry emits the cheapest operation that reproduces the stored data of
+// newEntry out of oldEntry.
+func (d *archiveDiffer) diffEntry(ctx context.Context, oldfp *os.File, oldEntry archiveEntry, newEntry archiveEntry, newData []byte) error {
+	oldData, err := readRange(oldfp, oldEntry.offset, oldEntry.size)
+	if err != nil {
+		return err
+	}
+
+	op := archiveOp{
+		Name:   newEntry.name,
+		Offset: oldEntry.offset,
+		Length: oldEntry.size,
+	}
+
+	if bytes.Equal(oldData, newData) {
+		op.Op = archiveOpCopy
+		return d.add(op, nil)
+	}
+
+	if oldEntry.method != zip.Store || newEntry.method != zip.Store {
+		d.literal(newData)
+		return nil
+	}
+
+	patch, err := bsdiffBytes(ctx, oldData, newData)
+	if err != nil {
+		return err
+	}
+	if len(patch) >= len(newData) {
+		d.literal(newData)
+		return nil
+	}
+
+	op.Op = archiveOpPatch
+	return d.add(op, patch)
+}
+
+// writeArchivePatch compares two archives entry by entry and writes a patch
+// container that describes how to rebuild newfile byte by byte out of
+// oldfile.
+func writeArchivePatch(ctx context.Context, oldfile string, newfile string, format AssetFormat, patchfile string) (err error) {
+	var oldEntries, newEntries []archiveEntry
+	if oldEntries, err = archiveEntries(oldfile, format); err != nil {
+		return fmt.Errorf("Could not read entries of %s: %v", oldfile, err)
+	}
+	if newEntries, err = archiveEntries(newfile, format); err != nil {
+		return fmt.Errorf("Could not read entries of %s: %v", newfile, err)
+	}
+
+	oldByName := make(map[string]archiveEntry, len(oldEntries))
+	for _, e := range oldEntries {
+		oldByName[e.name] = e
+	}
+
+	var oldfp, newfp *os.File
+	if oldfp, err = os.Open(oldfile); err != nil {
+		return err
+	}
+	defer oldfp.Close()
+	if newfp, err = os.Open(newfile); err != nil {
+		return err
+	}
+	defer newfp.Close()
+
+	var stat os.FileInfo
+	if stat, err = newfp.Stat(); err != nil {
+		return err
+	}
+
+	d := &archiveDiffer{}
+	if d.blobs, err = os.CreateTemp("", "autoupdate-blobs"); err != nil {
+		return err
+	}
+	defer os.Remove(d.blobs.Name())
+	defer d.blobs.Close()
+
+	var pos int64
+	for _, e := range newEntries {
+		// Headers and anything else between entries is sent verbatim.
+		if e.offset > pos {
+			var b []byte
+			if b, err = readRange(newfp, pos, e.offset-pos); err != nil {
+				return err
+			}
+			d.literal(b)
+		}
+
+		var newData []byte
+		if newData, err = readRange(newfp, e.offset, e.size); err != nil {
+			return err
+		}
+		if oldEntry, ok := oldByName[e.name]; ok {
+			if err = d.diffEntry(ctx, oldfp, oldEntry, e, newData); err != nil {
+				return fmt.Errorf("Could not diff entry %q: %v", e.name, err)
+			}
+		} else {
+			d.literal(newData)
+		}
+		pos = e.offset + e.size
+	}
+	if stat.Size() > pos {
+		var b []byte
+		if b, err = readRange(newfp, pos, stat.Size()-pos); err != nil {
+			return err
+		}
+		d.literal(b)
+	}
+	if err = d.flush(); err != nil {
+		return err
+	}
+
+	manifest := archiveManifest{
+		Version:  1,
+		Format:   format,
+		Size:     stat.Size(),
+		Checksum: fileHash(newfile),
+		Ops:      d.ops,
+	}
+
+	var mb []byte
+	if mb, err = json.Marshal(manifest); err != nil {
+		return err
+	}
+
+	var fp *os.File
+	if fp, err = os.Create(patchfile); err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := fp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(patchfile)
+		}
+	}()
+
+	if _, err = fp.WriteString(archivePatchMagic); err != nil {
+		return err
+	}
+	if err = binary.Write(fp, binary.BigEndian, uint32(len(mb))); err != nil {
+		return err
+	}
+	if _, err = fp.Write(mb); err != nil {
+		return err
+	}
+	if _, err = d.blobs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = io.Copy(fp, d.blobs); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// readArchiveManifest reads the manifest of an archive patch container and
+// returns it along with the offset of the blob area.
+func readArchiveManifest(r io.Reader) (*archiveManifest, int64, error) {
+	magic := make([]byte, len(archivePatchMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, 0, err
+	}
+	if string(magic) != archivePatchMagic {
+		return nil, 0, fmt.Errorf("not an archive patch")
+	}
+	var manifestLen uint32
+	if err := binary.Read(r, binary.BigEndian, &manifestLen); err != nil {
+		return nil, 0, err
+	}
+	var manifest archiveManifest
+	if err := json.NewDecoder(io.LimitReader(r, int64(manifestLen))).Decode(&manifest); err != nil {
+		return nil, 0, fmt.Errorf("could not decode manifest: %v", err)
+	}
+	return &manifest, int64(len(archivePatchMagic)) + 4 + int64(manifestLen), nil
+}
+
+// archivepatch rebuilds newfile by applying an archive patch container to
+// oldfile. It fails if the result does not match the checksum recorded in the
+// container.
+func archivepatch(oldfile string, newfile string, patchfile string) (err error) {
+	var pfp, oldfp, newfp *os.File
+
+	if pfp, err = os.Open(patchfile); err != nil {
+		return err
+	}
+	defer pfp.Close()
+
+	manifest, blobBase, err := readArchiveManifest(pfp)
+	if err != nil {
+		return fmt.Errorf("Could not read archive patch %s: %v", patchfile, err)
+	}
+
+	if oldfp, err = os.Open(oldfile); err != nil {
+		return err
+	}
+	defer oldfp.Close()
+
+	if newfp, err = os.Create(newfile); err != nil {
+		return err
+	}
+	defer newfp.Close()
+
+	h := sha256.New()
+	w := io.MultiWriter(newfp, h)
+
+	for _, op := range manifest.Ops {
+		switch op.Op {
+		case archiveOpData:
+			if _, err = io.Copy(w, io.NewSectionReader(pfp, blobBase+op.BlobOffset, op.BlobLength)); err != nil {
+				return err
+			}
+		case archiveOpCopy:
+			if _, err = io.Copy(w, io.NewSectionReader(oldfp, op.Offset, op.Length)); err != nil {
+				return err
+			}
+		case archiveOpPatch:
+			var src, patch, out []byte
+			if src, err = readRange(oldfp, op.Offset, op.Length); err != nil {
+				return err
+			}
+			if patch, err = readRange(pfp, blobBase+op.BlobOffset, op.BlobLength); err != nil {
+				return err
+			}
+			if out, err = bspatchBytes(src, patch); err != nil {
+				return fmt.Errorf("Could not patch entry %q: %v", op.Name, err)
+			}
+			if _, err = w.Write(out); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unknown archive patch operation %q", op.Op)
+		}
+	}
+
+	if checksum := fmt.Sprintf("%x", h.Sum(nil)); checksum != manifest.Checksum {
+		return fmt.Errorf("Checksum mismatch after applying archive patch, expecting %s, got %s", manifest.Checksum, checksum)
+	}
+
+	return nil
+}
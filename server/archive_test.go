@@ -0,0 +1,212 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+type testArchiveEntry struct {
+	name    string
+	content string
+	method  uint16
+}
+
+func zipArchive(t *testing.T, entries []testArchiveEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: e.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarArchive(t *testing.T, entries []testArchiveEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testArchiveRoundTrip diffs two archives, makes sure the patch rebuilds the
+// new one and returns the size of the patch along with the operations on
+// entries, keyed by entry name.
+func testArchiveRoundTrip(t *testing.T, format AssetFormat, oldContent []byte, newContent []byte) (int64, map[string]string) {
+	// fileHash caches hashes by file name, so every test needs its own files.
+	base := "_tests/" + t.Name()
+	oldfile, newfile := base+"-old."+string(format), base+"-new."+string(format)
+	patchfile, patchedfile := base+"."+string(format)+".patch", base+"-patched."+string(format)
+
+	if err := writeFile(oldfile, oldContent); err != nil {
+		t.Fatalf("Failed to write test file: %q", err)
+	}
+	if err := writeFile(newfile, newContent); err != nil {
+		t.Fatalf("Failed to write test file: %q", err)
+	}
+
+	for _, file := range []string{oldfile, newfile} {
+		detected, err := detectAssetFormat(file, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if detected != format {
+			t.Fatalf("Expecting %s to be detected as %s, got %s", file, format, detected)
+		}
+	}
+
+	if err := writeArchivePatch(context.Background(), oldfile, newfile, format, patchfile); err != nil {
+		t.Fatalf("Failed to generate archive patch: %v", err)
+	}
+	if err := archivepatch(oldfile, patchedfile, patchfile); err != nil {
+		t.Fatalf("Failed to apply archive patch: %v", err)
+	}
+	if fileHash(patchedfile) != fileHash(newfile) {
+		t.Fatal("File hashes after patch must be equal.")
+	}
+
+	fp, err := os.Open(patchfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	manifest, _, err := readArchiveManifest(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := make(map[string]string)
+	for _, op := range manifest.Ops {
+		if op.Name != "" {
+			ops[op.Name] = op.Op
+		}
+	}
+	return fileSize(patchfile), ops
+}
+
+func expectArchiveOps(t *testing.T, ops map[string]string, expected map[string]string) {
+	t.Helper()
+	for name, op := range expected {
+		if ops[name] != op {
+			t.Errorf("Expecting %q for entry %s, got %q", op, name, ops[name])
+		}
+	}
+}
+
+// randomText returns text that does not compress well, so patching entries
+// pays off.
+func randomText(n int) string {
+	r := rand.New(rand.NewSource(1))
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('a' + r.Intn(26))
+	}
+	return string(b)
+}
+
+func TestArchiveDiffZip(t *testing.T) {
+	large := randomText(16 * 1024)
+	oldContent := zipArchive(t, []testArchiveEntry{
+		{"unchanged.txt", large, zip.Deflate},
+		{"deflated.txt", large + "honey", zip.Deflate},
+		{"stored.bin", large + "honey", zip.Store},
+		{"removed.txt", "bye", zip.Deflate},
+	})
+	newContent := zipArchive(t, []testArchiveEntry{
+		{"added.txt", "hi", zip.Deflate},
+		{"unchanged.txt", large, zip.Deflate},
+		{"deflated.txt", large + "baby", zip.Deflate},
+		{"stored.bin", large + "baby", zip.Store},
+	})
+	size, ops := testArchiveRoundTrip(t, ASSETFORMAT_ZIP, oldContent, newContent)
+	if size >= int64(len(newContent))/2 {
+		t.Fatalf("Expecting the patch to be much smaller than the %d bytes of the new archive, got %d bytes", len(newContent), size)
+	}
+	// Changed deflated entries are shipped whole.
+	expectArchiveOps(t, ops, map[string]string{
+		"unchanged.txt": archiveOpCopy,
+		"stored.bin":    archiveOpPatch,
+		"deflated.txt":  "",
+	})
+}
+
+// The fixtures were written by Python's zipfile, which deflates with zlib like
+// most APK toolchains do. classes.dex is deflated and resources.arsc is
+// stored, both changed.
+func TestArchiveDiffZlib(t *testing.T) {
+	oldContent, err := os.ReadFile("testdata/zlib-old.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newContent, err := os.ReadFile("testdata/zlib-new.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, ops := testArchiveRoundTrip(t, ASSETFORMAT_ZIP, oldContent, newContent)
+	if size >= int64(len(newContent))/2 {
+		t.Fatalf("Expecting the patch to be much smaller than the %d bytes of the new archive, got %d bytes", len(newContent), size)
+	}
+	expectArchiveOps(t, ops, map[string]string{
+		"AndroidManifest.xml": archiveOpCopy,
+		"resources.arsc":      archiveOpPatch,
+		"classes.dex":         "",
+	})
+}
+
+func TestArchiveDiffTar(t *testing.T) {
+	large := strings.Repeat("don't you know that I'll always be true. ", 200)
+	oldContent := tarArchive(t, []testArchiveEntry{
+		{"App.app/Contents/Info.plist", "<plist>1</plist>", zip.Store},
+		{"App.app/Contents/MacOS/app", large + "honey", zip.Store},
+	})
+	newContent := tarArchive(t, []testArchiveEntry{
+		{"App.app/Contents/Info.plist", "<plist>2</plist>", zip.Store},
+		{"App.app/Contents/MacOS/app", large + "baby", zip.Store},
+		{"App.app/Contents/Resources/icon", "icon", zip.Store},
+	})
+	if size, _ := testArchiveRoundTrip(t, ASSETFORMAT_TAR, oldContent, newContent); size >= int64(len(newContent))/2 {
+		t.Fatalf("Expecting the patch to be much smaller than the %d bytes of the new archive, got %d bytes", len(newContent), size)
+	}
+}
+
+func TestDetectAssetFormat(t *testing.T) {
+	if err := writeFile("_tests/update_linux_amd64", []byte("\x7fELF")); err != nil {
+		t.Fatalf("Failed to write test file: %q", err)
+	}
+	for uri, expected := range map[string]AssetFormat{
+		"https://example.com/update_linux_amd64":     ASSETFORMAT_RAW,
+		"https://example.com/update_linux_amd64.bz2": ASSETFORMAT_BZIP2,
+	} {
+		format, err := detectAssetFormat(uri, "_tests/update_linux_amd64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != expected {
+			t.Fatalf("Expecting %s for %s, got %s", expected, uri, format)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"compress/bzip2"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -11,11 +12,18 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/getlantern/autoupdate-server/instrument"
 )
 
 const (
 	assetsDirectory = "assets/"
+	// Public path cached assets are served from.
+	assetsPath = "assets/"
 	// Downloading all assets from GitHub can be very slow and easily exceed
 	// the 10 min time limit imposed by CI
 	envSkipDownload = "SKIP_DOWNLOAD_FOR_TEST"
@@ -29,8 +37,12 @@ func init() {
 }
 
 // downloadAsset downloads the body of the given URL and stores it into
-// $ASSETS_DIRECTORY/$BASENAME.SHA256_SUM($URL)
-func downloadAsset(uri string) (localfile string, err error) {
+// $ASSETS_DIRECTORY/$BASENAME.SHA256_SUM($URL). The download is aborted when
+// ctx is done.
+func downloadAsset(ctx context.Context, uri string) (localfile string, err error) {
+	ctx, span := instrument.Start(ctx, "download")
+	defer span.End()
+	span.SetAttributes(attribute.String("url", uri))
 	basename := path.Base(uri)
 	fileExt := path.Ext(basename)
 
@@ -47,10 +59,14 @@ func downloadAsset(uri string) (localfile string, err error) {
 		if skip, _ := strconv.ParseBool(os.Getenv(envSkipDownload)); skip {
 			log.Debugf("Skip downloading %v in tests", uri)
 		} else {
+			var req *http.Request
 			var res *http.Response
 
+			if req, err = http.NewRequestWithContext(ctx, http.MethodGet, uri, nil); err != nil {
+				return "", err
+			}
 			c := http.Client{Timeout: time.Second * 30}
-			if res, err = c.Get(uri); err != nil {
+			if res, err = c.Do(req); err != nil {
 				return "", err
 			}
 			defer res.Body.Close()
@@ -74,6 +90,8 @@ func downloadAsset(uri string) (localfile string, err error) {
 		defer fp.Close()
 
 		if _, err = io.Copy(fp, body); err != nil {
+			// Don't leave a truncated asset behind to be picked up later.
+			os.Remove(localfile)
 			return "", err
 		}
 
@@ -81,3 +99,15 @@ func downloadAsset(uri string) (localfile string, err error) {
 
 	return localfile, nil
 }
+
+// localAssetURL returns the address of the cached copy of an asset, as served
+// by the /assets/ endpoint. Assets are addressed by checksum, so the URL
+// changes if the contents do. Cached copies of .bz2 assets are stored
+// decompressed, so the extension is dropped.
+func localAssetURL(publicAddr string, checksum string, uri string) string {
+	return publicAddr + assetsPath + checksum + "/" + localAssetName(uri)
+}
+
+func localAssetName(uri string) string {
+	return strings.TrimSuffix(path.Base(uri), ".bz2")
+}
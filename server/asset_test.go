@@ -1,8 +1,17 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
 	"testing"
+
+	"github.com/blang/semver"
 )
 
 const (
@@ -11,7 +20,7 @@ const (
 )
 
 func TestDownloadAsset(t *testing.T) {
-	s, err := downloadAsset(testAssetURL)
+	s, err := downloadAsset(context.Background(), testAssetURL)
 	if err != nil {
 		t.Fatal(fmt.Errorf("Failed to download asset: %q", err))
 	}
@@ -19,3 +28,74 @@ func TestDownloadAsset(t *testing.T) {
 		t.Fatal("Unexpected signature.")
 	}
 }
+
+func TestServeCachedAssets(t *testing.T) {
+	rm := newTestReleaseManager(t)
+	rm.SetPublicAddr("http://127.0.0.1:9999/")
+	rm.SetConfig(&AppConfig{ServeAssets: true})
+
+	// Pushed by hand since cached copies of .bz2 assets are served without
+	// the extension.
+	githubURL := "https://github.com/getlantern/lantern/releases/download/7.0.0/update_linux_amd64.bz2"
+	asset := &Asset{URL: githubURL, v: semver.MustParse("7.0.0")}
+	if err := rm.pushAsset(context.Background(), OS.Linux, Arch.X64, asset); err != nil {
+		t.Fatalf("Could not push asset: %v", err)
+	}
+
+	r := expectUpdate(t, rm, testParams("6.0.0"), "7.0.0")
+	localURL := "http://127.0.0.1:9999/assets/" + asset.Checksum + "/update_linux_amd64"
+	if r.URL != localURL {
+		t.Fatalf("Expecting %s, got %s", localURL, r.URL)
+	}
+	if len(r.URLs) != 2 || r.URLs[1] != githubURL {
+		t.Fatalf("Expecting Github as a fallback, got %v", r.URLs)
+	}
+
+	rm.SetConfig(&AppConfig{ServeAssets: true, AssetMirrors: []Mirror{{BaseURL: "https://cdn.example.com"}}})
+	r = expectUpdate(t, rm, testParams("6.0.0"), "7.0.0")
+	urls := []string{localURL, githubURL, "https://cdn.example.com/getlantern/lantern/releases/download/7.0.0/update_linux_amd64.bz2"}
+	if r.URL != localURL || !reflect.DeepEqual(r.URLs, urls) {
+		t.Fatalf("Expecting mirrors of the Github URL after the local one, got %v", r.URLs)
+	}
+
+	u := NewUpdateServer("http://127.0.0.1:9999/", "127.0.0.1:0", ".", 0)
+	u.apps["lantern"] = rm
+	srv := httptest.NewServer(u.mux)
+	defer srv.Close()
+
+	expected, err := os.ReadFile(asset.LocalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Go's HTTP client asks for gzip and decompresses transparently.
+	res, err := http.Get(srv.URL + "/assets/" + asset.Checksum + "/update_linux_amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !bytes.Equal(body, expected) {
+		t.Fatalf("Unexpected response %s: %q", res.Status, body)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/assets/"+asset.Checksum+"/update_linux_amd64", nil)
+	req.Header.Set("Range", "bytes=1-")
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent || !bytes.Equal(body, expected[1:]) {
+		t.Fatalf("Unexpected range response %s: %q", res.Status, body)
+	}
+
+	for _, p := range []string{"/assets/" + asset.Checksum + "/update_linux_amd64.bz2", "/assets/nope/update_linux_amd64", "/assets/"} {
+		if res, err = http.Get(srv.URL + p); err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expecting 404 for %s, got %s", p, res.Status)
+		}
+	}
+}
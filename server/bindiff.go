@@ -1,12 +1,14 @@
 package server
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"sync"
+	"time"
 )
 
 var (
@@ -19,7 +21,9 @@ func init() {
 }
 
 var (
-	generatePatchMu sync.Mutex
+	// patchSlots limits patch generations to one at a time, see
+	// acquirePatchSlot.
+	patchSlots = make(chan struct{}, 1)
 )
 
 // Patch struct is a representation of a patch generated by bsdiff.
@@ -27,6 +31,7 @@ type Patch struct {
 	oldfile string
 	newfile string
 	File    string
+	Type    PatchType
 }
 
 const (
@@ -47,6 +52,13 @@ func fileExists(s string) bool {
 	return false
 }
 
+func fileSize(s string) int64 {
+	if stat, err := os.Stat(s); err == nil {
+		return stat.Size()
+	}
+	return 0
+}
+
 func fileHash(s string) string {
 	fileHashMapMu.Lock()
 	defer fileHashMapMu.Unlock()
@@ -96,7 +108,7 @@ func bspatch(oldfile string, newfile string, patchfile string) (err error) {
 	return nil
 }
 
-func bsdiff(oldfile string, newfile string) (patchfile string, err error) {
+func bsdiff(ctx context.Context, oldfile string, newfile string) (patchfile string, err error) {
 	if !fileExists(oldfile) {
 		return "", fmt.Errorf("File %s does not exist.", oldfile)
 	}
@@ -108,14 +120,24 @@ func bsdiff(oldfile string, newfile string) (patchfile string, err error) {
 	oldfileHash := fileHash(oldfile)
 	newfileHash := fileHash(newfile)
 
-	patchfile = patchesDirectory + fmt.Sprintf("%x", sha256.Sum256([]byte(oldfileHash+"|"+newfileHash)))
+	patchfile = patchesDirectory + patchName(oldfileHash, newfileHash, PATCHTYPE_BSDIFF)
 
 	if fileExists(patchfile) {
 		// Patch already exists, no need to compute it again.
 		return patchfile, nil
 	}
 
-	cmd := exec.Command(
+	if err = runBsdiff(ctx, oldfile, newfile, patchfile); err != nil {
+		return "", err
+	}
+
+	return patchfile, nil
+}
+
+// runBsdiff runs bsdiff, killing it if ctx is done before it completes.
+func runBsdiff(ctx context.Context, oldfile string, newfile string, patchfile string) error {
+	cmd := exec.CommandContext(
+		ctx,
 		"bsdiff",
 		oldfile,
 		newfile,
@@ -123,30 +145,121 @@ func bsdiff(oldfile string, newfile string) (patchfile string, err error) {
 	)
 
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("Failed to generate patch with bsdiff: %q", err)
+		if ctx.Err() != nil {
+			os.Remove(patchfile)
+			return fmt.Errorf("Generating patch with bsdiff was cancelled: %v", ctx.Err())
+		}
+		return fmt.Errorf("Failed to generate patch with bsdiff: %q", err)
+	}
+
+	return nil
+}
+
+// archivediff generates an archive patch container that rebuilds newfile out
+// of oldfile entry by entry, and makes sure it reproduces newfile exactly.
+func archivediff(ctx context.Context, oldfile string, newfile string, format AssetFormat) (patchfile string, err error) {
+	if !fileExists(oldfile) {
+		return "", fmt.Errorf("File %s does not exist.", oldfile)
+	}
+
+	if !fileExists(newfile) {
+		return "", fmt.Errorf("File %s does not exist.", newfile)
+	}
+
+	oldfileHash := fileHash(oldfile)
+	newfileHash := fileHash(newfile)
+
+	patchfile = patchesDirectory + patchName(oldfileHash, newfileHash, PATCHTYPE_ARCHIVE)
+
+	if fileExists(patchfile) {
+		// Patch already exists, no need to compute it again.
+		return patchfile, nil
+	}
+
+	if err = writeArchivePatch(ctx, oldfile, newfile, format, patchfile); err != nil {
+		return "", err
+	}
+
+	// Rebuilding the new file is the only way to be sure clients will end up
+	// with the expected checksum.
+	rebuilt := patchfile + ".verify"
+	defer os.Remove(rebuilt)
+	if err = archivepatch(oldfile, rebuilt, patchfile); err != nil {
+		os.Remove(patchfile)
+		return "", fmt.Errorf("Archive patch does not reproduce %s: %v", newfile, err)
 	}
 
 	return patchfile, nil
 }
 
+// acquirePatchSlot waits for the other patch generations to complete, giving
+// up once ctx is done.
+func acquirePatchSlot(ctx context.Context) error {
+	select {
+	case patchSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("patch generation cancelled while waiting for others: %v", ctx.Err())
+	}
+}
+
+func releasePatchSlot() {
+	<-patchSlots
+}
+
 // generatePatch compares the contents of two URLs and generates a patch.
-func generatePatch(oldfileURL string, newfileURL string) (p *Patch, err error) {
-	generatePatchMu.Lock()
-	defer generatePatchMu.Unlock()
+func generatePatch(ctx context.Context, oldfileURL string, newfileURL string) (p *Patch, err error) {
+	if err = acquirePatchSlot(ctx); err != nil {
+		return nil, err
+	}
+	defer releasePatchSlot()
+
+	start := time.Now()
+	defer func() { observePatchGeneration(PATCHTYPE_BSDIFF, start, p, err) }()
+
+	p = new(Patch)
+
+	if p.oldfile, err = downloadAsset(ctx, oldfileURL); err != nil {
+		return nil, err
+	}
+
+	if p.newfile, err = downloadAsset(ctx, newfileURL); err != nil {
+		return nil, err
+	}
+
+	if p.File, err = bsdiff(ctx, p.oldfile, p.newfile); err != nil {
+		return nil, err
+	}
+	p.Type = PATCHTYPE_BSDIFF
+
+	return p, nil
+}
+
+// generateArchivePatch compares the contents of two archives entry by entry
+// and generates an archive patch.
+func generateArchivePatch(ctx context.Context, oldfileURL string, newfileURL string, format AssetFormat) (p *Patch, err error) {
+	if err = acquirePatchSlot(ctx); err != nil {
+		return nil, err
+	}
+	defer releasePatchSlot()
+
+	start := time.Now()
+	defer func() { observePatchGeneration(PATCHTYPE_ARCHIVE, start, p, err) }()
 
 	p = new(Patch)
 
-	if p.oldfile, err = downloadAsset(oldfileURL); err != nil {
+	if p.oldfile, err = downloadAsset(ctx, oldfileURL); err != nil {
 		return nil, err
 	}
 
-	if p.newfile, err = downloadAsset(newfileURL); err != nil {
+	if p.newfile, err = downloadAsset(ctx, newfileURL); err != nil {
 		return nil, err
 	}
 
-	if p.File, err = bsdiff(p.oldfile, p.newfile); err != nil {
+	if p.File, err = archivediff(ctx, p.oldfile, p.newfile, format); err != nil {
 		return nil, err
 	}
+	p.Type = PATCHTYPE_ARCHIVE
 
 	return p, nil
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
@@ -35,7 +36,7 @@ func TestBinaryDiff(t *testing.T) {
 	}
 	// Creating binary diffs.
 	var patchfile string
-	if patchfile, err = bsdiff("_tests/file-a", "_tests/file-b"); err != nil {
+	if patchfile, err = bsdiff(context.Background(), "_tests/file-a", "_tests/file-b"); err != nil {
 		t.Fatal(fmt.Sprintf("Failed to generate binary diff: %q", err))
 	}
 	// Testing patch application.
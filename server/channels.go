@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+const (
+	// Tag clients use to pick a release channel.
+	channelTag = "channel"
+	// CHANNEL_STABLE only offers releases that are not marked as prereleases
+	// on Github. It's the channel of clients that don't send a channel tag.
+	CHANNEL_STABLE = "stable"
+)
+
+var (
+	// Channels offered when an app doesn't configure its own. Each one
+	// includes the releases of the previous one.
+	defaultChannels = []Channel{
+		{Name: "beta", Stable: true, TagPattern: `-(beta|rc)`},
+		{Name: "nightly", Stable: true, TagPattern: `.`},
+	}
+
+	stableChannel = &Channel{Name: CHANNEL_STABLE, Stable: true}
+
+	tagPatterns   = make(map[string]*regexp.Regexp)
+	tagPatternsMu sync.Mutex
+)
+
+// Channel selects the releases offered to the clients on a release channel.
+//
+// Clients only ever move forward: a client switching to a channel whose
+// latest release is older than the one it runs, like from beta back to
+// stable, stays on its version until the channel catches up.
+type Channel struct {
+	Name string `json:"name"`
+	// Stable includes the Github releases that are not marked as
+	// prereleases.
+	Stable bool `json:"stable,omitempty"`
+	// TagPattern includes the releases whose tag matches this regular
+	// expression, prereleases or not.
+	TagPattern string `json:"tag_pattern,omitempty"`
+}
+
+func (ch *Channel) validate() error {
+	if ch.Name == "" {
+		return fmt.Errorf("channel name is required")
+	}
+	if ch.Name == CHANNEL_STABLE {
+		return fmt.Errorf("the %s channel can't be redefined", CHANNEL_STABLE)
+	}
+	if _, err := regexp.Compile(ch.TagPattern); err != nil {
+		return fmt.Errorf("bad tag pattern for channel %s: %v", ch.Name, err)
+	}
+	return nil
+}
+
+// includes returns true if the given asset belongs to a release of this
+// channel. Assets that don't come from a Github release are matched by
+// version.
+func (ch *Channel) includes(a *Asset) bool {
+	if ch.Stable && !a.Prerelease {
+		return true
+	}
+	if ch.TagPattern == "" {
+		return false
+	}
+	tag := a.Tag
+	if tag == "" {
+		tag = a.v.String()
+	}
+	re := tagPattern(ch.TagPattern)
+	return re != nil && re.MatchString(tag)
+}
+
+// tagPattern returns the compiled form of a tag pattern, or nil if it's not
+// valid.
+func tagPattern(pattern string) *regexp.Regexp {
+	tagPatternsMu.Lock()
+	defer tagPatternsMu.Unlock()
+
+	re, ok := tagPatterns[pattern]
+	if !ok {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			log.Errorf("Ignoring bad tag pattern %q: %v", pattern, err)
+		}
+		tagPatterns[pattern] = re
+	}
+	return re
+}
+
+// channels returns the release channels of the app besides stable.
+func (c *AppConfig) channels() []Channel {
+	if c.Channels != nil {
+		return c.Channels
+	}
+	return defaultChannels
+}
+
+// channel returns the channel with the given name. Clients asking for an
+// unknown channel get the stable one.
+func (c *AppConfig) channel(name string) *Channel {
+	if name == "" || name == CHANNEL_STABLE {
+		return stableChannel
+	}
+	channels := c.channels()
+	for i := range channels {
+		if channels[i].Name == name {
+			return &channels[i]
+		}
+	}
+	log.Debugf("Unknown release channel %q, using %s.", name, CHANNEL_STABLE)
+	return stableChannel
+}
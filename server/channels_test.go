@@ -0,0 +1,56 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func TestReleaseChannels(t *testing.T) {
+	rm := newTestReleaseManager(t, "7.0.0", "7.1.0-beta.1", "7.2.0-nightly.1")
+	check := func(appVersion string, channel string, expected string) {
+		t.Helper()
+		params := testParams(appVersion)
+		params.Tags = map[string]string{"channel": channel}
+		expectUpdate(t, rm, params, expected)
+	}
+
+	check("6.0.0", "", "7.0.0")
+	check("6.0.0", "stable", "7.0.0")
+	check("6.0.0", "unknown", "7.0.0")
+	check("6.0.0", "beta", "7.1.0-beta.1")
+	check("6.0.0", "nightly", "7.2.0-nightly.1")
+
+	// Moving back to stable never downgrades.
+	check("7.1.0-beta.1", "stable", "")
+	check("7.1.0-beta.1", "beta", "")
+
+	// Custom channels are indexed when they are configured.
+	rm.SetConfig(&AppConfig{Channels: []Channel{{Name: "qa", TagPattern: `-nightly\.`}}})
+	check("6.0.0", "qa", "7.2.0-nightly.1")
+	check("6.0.0", "beta", "7.0.0")
+
+	// Channels without releases offer no update.
+	rm.SetConfig(&AppConfig{Channels: []Channel{{Name: "empty", TagPattern: `-never\.`}}})
+	check("6.0.0", "empty", "")
+
+	// Tag patterns match the tags of Github releases.
+	hotfix := &Channel{Name: "hotfix", TagPattern: `^hotfix-`}
+	if !hotfix.includes(&Asset{v: semver.MustParse("7.3.0"), Tag: "hotfix-7.3.0", Prerelease: true}) {
+		t.Fatal("Expecting the release to be matched by its tag")
+	}
+}
+
+func TestValidateChannels(t *testing.T) {
+	for _, channels := range [][]Channel{
+		{{Name: ""}},
+		{{Name: "stable", Stable: true}},
+		{{Name: "beta", TagPattern: "("}},
+		{{Name: "beta"}, {Name: "beta"}},
+	} {
+		cfg := &AppConfig{Channels: channels}
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("Expecting %v to be rejected", channels)
+		}
+	}
+}
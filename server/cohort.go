@@ -0,0 +1,286 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// Tags holding the country code and the ISP of the client. They are
+	// filled in from the GeoIP database if clients don't send them.
+	countryTag = "country"
+	ispTag     = "isp"
+)
+
+// Cohort is a group of clients releases can be rolled out to first.
+type Cohort struct {
+	Name string `json:"name"`
+	// Countries are ISO 3166-1 alpha-2 country codes, any country if empty.
+	Countries []string `json:"countries,omitempty"`
+	// ISPs are ISP names, any ISP if empty.
+	ISPs []string `json:"isps,omitempty"`
+}
+
+func (c *Cohort) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("cohort name is required")
+	}
+	return nil
+}
+
+func (c *Cohort) matches(p *Params) bool {
+	return matchesAny(c.Countries, p.Tags[countryTag]) && matchesAny(c.ISPs, p.Tags[ispTag])
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// cohort returns the name of the first cohort the client belongs to, if any.
+func (c *AppConfig) cohort(p *Params) string {
+	for i := range c.Cohorts {
+		if c.Cohorts[i].matches(p) {
+			return c.Cohorts[i].Name
+		}
+	}
+	return ""
+}
+
+// geoIPRange maps a range of IP addresses to a location.
+type geoIPRange struct {
+	first   netip.Addr
+	last    netip.Addr
+	country string
+	isp     string
+}
+
+// GeoIPDB looks up the country and ISP of IP addresses in a local CSV file.
+// Each line holds either a network in CIDR notation or the first and last
+// addresses of a range, followed by a country code and optionally an ISP:
+//
+//	1.0.0.0/24,AU,Cloudflare
+//	2.16.0.0,2.16.7.255,FR
+//
+// This is the format of the DB-IP Lite country database. Ranges must not
+// overlap.
+type GeoIPDB struct {
+	ranges []geoIPRange // Sorted by first address, disjoint.
+}
+
+// LoadGeoIPDB reads a GeoIP database from the given CSV file.
+func LoadGeoIPDB(file string) (*GeoIPDB, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	r := csv.NewReader(fp)
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+
+	db := &GeoIPDB{}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not read GeoIP database %s: %v", file, err)
+		}
+		rng, err := parseGeoIPRange(record)
+		if err != nil {
+			line, _ := r.FieldPos(0)
+			return nil, fmt.Errorf("Bad GeoIP range at %s:%d: %v", file, line, err)
+		}
+		db.ranges = append(db.ranges, rng)
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return db.ranges[i].first.Less(db.ranges[j].first)
+	})
+	// Lookups expect disjoint ranges, adjacent ranges of the same location
+	// are merged to keep them short.
+	merged := db.ranges[:0]
+	for _, rng := range db.ranges {
+		if n := len(merged); n > 0 {
+			prev := &merged[n-1]
+			if !prev.last.Less(rng.first) {
+				return nil, fmt.Errorf("Overlapping GeoIP ranges %s-%s and %s-%s in %s", prev.first, prev.last, rng.first, rng.last, file)
+			}
+			if prev.last.Next() == rng.first && prev.country == rng.country && prev.isp == rng.isp {
+				prev.last = rng.last
+				continue
+			}
+		}
+		merged = append(merged, rng)
+	}
+	db.ranges = merged
+	return db, nil
+}
+
+func parseGeoIPRange(record []string) (rng geoIPRange, err error) {
+	var location []string
+	if strings.Contains(record[0], "/") {
+		var prefix netip.Prefix
+		if prefix, err = netip.ParsePrefix(record[0]); err != nil {
+			return rng, err
+		}
+		prefix = prefix.Masked()
+		rng.first = prefix.Addr()
+		rng.last = lastAddr(prefix)
+		location = record[1:]
+	} else {
+		if len(record) < 2 {
+			return rng, fmt.Errorf("expecting an address range")
+		}
+		if rng.first, err = netip.ParseAddr(record[0]); err != nil {
+			return rng, err
+		}
+		if rng.last, err = netip.ParseAddr(record[1]); err != nil {
+			return rng, err
+		}
+		if rng.last.Less(rng.first) || rng.first.Is4() != rng.last.Is4() {
+			return rng, fmt.Errorf("bad address range %s-%s", rng.first, rng.last)
+		}
+		location = record[2:]
+	}
+	if len(location) == 0 {
+		return rng, fmt.Errorf("country is required")
+	}
+	rng.country = strings.ToUpper(strings.TrimSpace(location[0]))
+	if len(location) > 1 {
+		rng.isp = strings.TrimSpace(location[1])
+	}
+	return rng, nil
+}
+
+// lastAddr returns the last address of a masked prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(b)*8; bit++ {
+		b[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// Lookup returns the country code and the ISP of the given address.
+func (db *GeoIPDB) Lookup(addr netip.Addr) (country string, isp string, ok bool) {
+	addr = addr.Unmap()
+	// Find the last range starting at or before addr.
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return addr.Less(db.ranges[i].first)
+	}) - 1
+	if i < 0 || db.ranges[i].last.Less(addr) {
+		return "", "", false
+	}
+	return db.ranges[i].country, db.ranges[i].isp, true
+}
+
+// locate fills in the country and ISP tags of clients that don't send them.
+func (db *GeoIPDB) locate(p *Params, r *http.Request, trustedProxies []netip.Prefix) {
+	if addr, ok := requestAddr(r, trustedProxies); ok {
+		db.locateAddr(p, addr)
+	}
+}
+
+// locateAddr fills in the country and ISP tags of the client from the given
+// address if it doesn't send them.
+func (db *GeoIPDB) locateAddr(p *Params, addr netip.Addr) {
+	if p.Tags[countryTag] != "" && p.Tags[ispTag] != "" {
+		return
+	}
+	country, isp, ok := db.Lookup(addr)
+	if !ok {
+		return
+	}
+	if p.Tags == nil {
+		p.Tags = make(map[string]string)
+	}
+	if p.Tags[countryTag] == "" {
+		p.Tags[countryTag] = country
+	}
+	if p.Tags[ispTag] == "" && isp != "" {
+		p.Tags[ispTag] = isp
+	}
+}
+
+// ParseTrustedProxies parses the addresses or networks in CIDR notation of
+// the proxies in front of the server.
+func ParseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("bad trusted proxy %q: %v", proxy, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted proxy %q: %v", proxy, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func isTrustedProxy(trustedProxies []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestAddr returns the address of the client. X-Forwarded-For is only
+// honored on requests coming from trusted proxies, otherwise clients could
+// pick their location. The client is then the last address in it that isn't
+// a trusted proxy itself.
+func requestAddr(r *http.Request, trustedProxies []netip.Prefix) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return addr, false
+	}
+	addr = addr.Unmap()
+	if !isTrustedProxy(trustedProxies, addr) {
+		return addr, true
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// Anything before a bad entry can't be trusted.
+			break
+		}
+		addr = hop.Unmap()
+		if !isTrustedProxy(trustedProxies, addr) {
+			break
+		}
+	}
+	return addr, true
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestGeoIPDB(t *testing.T) {
+	file := path.Join(t.TempDir(), "geoip.csv")
+	err := os.WriteFile(file, []byte(`# network or range, country, ISP
+5.52.0.0/16,ir,Irancell
+2.16.0.0,2.16.7.255,FR
+2001:db8::/32,CN,China Telecom
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := LoadGeoIPDB(file)
+	if err != nil {
+		t.Fatalf("Could not load GeoIP database: %v", err)
+	}
+
+	for _, test := range []struct {
+		addr    string
+		country string
+		isp     string
+	}{
+		{"5.52.0.0", "IR", "Irancell"},
+		{"5.52.255.255", "IR", "Irancell"},
+		{"::ffff:5.52.1.1", "IR", "Irancell"},
+		{"5.53.0.0", "", ""},
+		{"2.16.3.4", "FR", ""},
+		{"2.16.8.0", "", ""},
+		{"2001:db8::1", "CN", "China Telecom"},
+		{"1.1.1.1", "", ""},
+	} {
+		country, isp, _ := db.Lookup(netip.MustParseAddr(test.addr))
+		if country != test.country || isp != test.isp {
+			t.Fatalf("Expecting %q/%q for %s, got %q/%q", test.country, test.isp, test.addr, country, isp)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/update", nil)
+	req.RemoteAddr = "5.52.3.4:1234"
+	p := &Params{}
+	db.locate(p, req, nil)
+	if p.Tags[countryTag] != "IR" || p.Tags[ispTag] != "Irancell" {
+		t.Fatalf("Expecting client to be located in IR, got %v", p.Tags)
+	}
+
+	req.Header.Set("X-Forwarded-For", "2.16.0.1, 10.0.0.1")
+	p = &Params{Tags: map[string]string{countryTag: "US"}}
+	db.locate(p, req, nil)
+	if p.Tags[countryTag] != "US" {
+		t.Fatalf("Client supplied country should be kept, got %v", p.Tags)
+	}
+
+	for _, bad := range []string{
+		"2.16.7.255,2.16.0.0,FR\n",
+		"2.16.0.0/16,FR\n2.16.1.0/24,DE\n",
+		"2.16.0.0,2.16.7.255,FR\n2.16.7.0,2.16.8.255,DE\n",
+	} {
+		if err := os.WriteFile(file, []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadGeoIPDB(file); err == nil {
+			t.Fatalf("Expecting %q to be rejected", bad)
+		}
+	}
+
+	if err := os.WriteFile(file, []byte("2.16.0.0/24,FR\n2.16.1.0/24,FR\n2.16.2.0/24,DE\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = LoadGeoIPDB(file); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.ranges) != 2 {
+		t.Fatalf("Expecting adjacent ranges of the same location to be merged, got %v", db.ranges)
+	}
+	if country, _, _ := db.Lookup(netip.MustParseAddr("2.16.1.200")); country != "FR" {
+		t.Fatalf("Expecting FR, got %q", country)
+	}
+}
+
+func TestRequestAddr(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", " 192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseTrustedProxies([]string{"proxy"}); err == nil {
+		t.Fatal("Expecting bad proxies to be rejected")
+	}
+
+	for _, test := range []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"5.52.3.4:1234", "", "5.52.3.4"},
+		// Anyone can send X-Forwarded-For.
+		{"5.52.3.4:1234", "2.16.0.1", "5.52.3.4"},
+		{"10.1.2.3:1234", "2.16.0.1", "2.16.0.1"},
+		// Clients can prepend anything, the first untrusted hop from the
+		// right is the client.
+		{"10.1.2.3:1234", "2.16.0.1, 5.52.3.4, 192.168.1.1", "5.52.3.4"},
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+		{"10.1.2.3:1234", "2.16.0.1, junk", "10.1.2.3"},
+		{"[::ffff:10.1.2.3]:1234", "2.16.0.1", "2.16.0.1"},
+	} {
+		req := httptest.NewRequest("POST", "/update", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		addr, ok := requestAddr(req, trusted)
+		if !ok || addr.String() != test.expected {
+			t.Errorf("Expecting %s for %s forwarding %q, got %v", test.expected, test.remoteAddr, test.forwarded, addr)
+		}
+	}
+}
+
+func TestCohortRollout(t *testing.T) {
+	rm := newTestReleaseManager(t, "7.0.0", "7.1.0")
+	cfg := &AppConfig{
+		Cohorts: []Cohort{
+			{Name: "iran-mobile", Countries: []string{"IR"}, ISPs: []string{"Irancell", "MCI"}},
+			{Name: "iran", Countries: []string{"ir"}},
+		},
+		Rollouts: []Rollout{{Version: "7.1.0", Percentage: 100, Cohorts: []string{"iran-mobile"}}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	rm.SetConfig(cfg)
+
+	for _, test := range []struct {
+		tags     map[string]string
+		cohort   string
+		expected string
+	}{
+		{map[string]string{"country": "IR", "isp": "MCI"}, "iran-mobile", "7.1.0"},
+		{map[string]string{"country": "IR", "isp": "TCI"}, "iran", "7.0.0"},
+		{map[string]string{"country": "CN"}, "", "7.0.0"},
+		{nil, "", "7.0.0"},
+	} {
+		params := testParams("6.0.0")
+		params.Tags = test.tags
+		if cohort := cfg.cohort(params); cohort != test.cohort {
+			t.Fatalf("Expecting cohort %q for %v, got %q", test.cohort, test.tags, cohort)
+		}
+		expectUpdate(t, rm, params, test.expected)
+	}
+
+	bad := &AppConfig{Rollouts: []Rollout{{Version: "7.1.0", Percentage: 10, Cohorts: []string{"nowhere"}}}}
+	if err := bad.Validate(); err == nil {
+		t.Fatal("Expecting rollouts to unknown cohorts to be rejected")
+	}
+}
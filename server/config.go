@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+// AppConfig holds the settings of a single app served by the update server.
+// The zero value keeps the default behavior.
+type AppConfig struct {
+	// AssetMirrors are alternative locations of the full update assets.
+	AssetMirrors []Mirror `json:"asset_mirrors,omitempty"`
+	// PatchMirrors are alternative locations of the generated patches.
+	PatchMirrors []Mirror `json:"patch_mirrors,omitempty"`
+	// ServeAssets sends clients to the copies of the full assets cached by
+	// this server instead of to Github. The Github URL is kept as a fallback.
+	ServeAssets bool `json:"serve_assets,omitempty"`
+	// Rollouts limit releases to a percentage of clients. Clients left out
+	// are offered the newest release they are eligible for.
+	Rollouts []Rollout `json:"rollouts,omitempty"`
+	// RolloutTag is the tag that identifies clients for rollouts. The user
+	// ID is used if empty.
+	RolloutTag string `json:"rollout_tag,omitempty"`
+	// Channels are the release channels clients can pick with the "channel"
+	// tag, besides stable. Defaults to beta and nightly.
+	Channels []Channel `json:"channels,omitempty"`
+	// Rules override the update offered to matching clients, the first
+	// matching rule wins. The lantern app has default rules for old OS
+	// versions, setting rules replaces them.
+	Rules []Rule `json:"rules,omitempty"`
+	// LastWindowsXPVersion and LastOSXYosemiteVersion are the versions the
+	// default rules of lantern pin Windows XP and OSX Yosemite or below to,
+	// 5.4.1 if empty.
+	LastWindowsXPVersion   string `json:"last_windows_xp_version,omitempty"`
+	LastOSXYosemiteVersion string `json:"last_osx_yosemite_version,omitempty"`
+	// MinVersion is the oldest supported version of the app. Older clients
+	// get a mandatory automatic update.
+	MinVersion string `json:"min_version,omitempty"`
+	// Initiatives sets how clients apply specific releases, keyed by
+	// version. Releases are applied automatically by default, "manual"
+	// releases are only offered to the user and "never" releases are never
+	// applied.
+	Initiatives map[string]Initiative `json:"initiatives,omitempty"`
+	// PausedVersions are releases that must not be offered anymore. Clients
+	// get the newest release before them instead.
+	PausedVersions []string `json:"paused_versions,omitempty"`
+	// Rollbacks send the clients running broken releases back to previous
+	// ones. Broken releases are not offered either.
+	Rollbacks []Rollback `json:"rollbacks,omitempty"`
+	// BlockedVersions are releases that are never offered as updates, like
+	// builds with a broken updater. Clients running them still get patches
+	// to newer releases.
+	BlockedVersions []string `json:"blocked_versions,omitempty"`
+	// BlockedChecksums are assets that are never offered as updates.
+	BlockedChecksums []string `json:"blocked_checksums,omitempty"`
+	// RateLimit limits the updates offered for the app, the -r flag applies
+	// if it's not set.
+	RateLimit RateLimit `json:"rate_limit,omitempty"`
+	// ReleaseRateLimits limit the updates offered for specific releases on
+	// top of the app limit, keyed by version.
+	ReleaseRateLimits map[string]RateLimit `json:"release_rate_limits,omitempty"`
+	// Activations are the times at which releases become available, keyed
+	// by version. Releases without an activation time are available right
+	// away.
+	Activations map[string]time.Time `json:"activations,omitempty"`
+	// UpdateWindows restrict the times of the day at which updates are
+	// offered, to keep clear of peak traffic.
+	UpdateWindows []UpdateWindow `json:"update_windows,omitempty"`
+	// Cohorts group clients by country and ISP so that releases can be
+	// rolled out to some of them first. Clients belong to the first cohort
+	// they match.
+	Cohorts []Cohort `json:"cohorts,omitempty"`
+}
+
+// Validate checks that the settings are consistent.
+func (c *AppConfig) Validate() error {
+	for _, mirrors := range [][]Mirror{c.AssetMirrors, c.PatchMirrors} {
+		for _, m := range mirrors {
+			if err := m.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	cohorts := make(map[string]bool)
+	for i := range c.Cohorts {
+		if err := c.Cohorts[i].validate(); err != nil {
+			return err
+		}
+		cohorts[c.Cohorts[i].Name] = true
+	}
+	for i := range c.Rollouts {
+		if err := c.Rollouts[i].validate(); err != nil {
+			return err
+		}
+		for _, cohort := range c.Rollouts[i].Cohorts {
+			if !cohorts[cohort] {
+				return fmt.Errorf("rollout of %s targets unknown cohort %s", c.Rollouts[i].Version, cohort)
+			}
+		}
+	}
+	names := make(map[string]bool)
+	for i := range c.Channels {
+		if err := c.Channels[i].validate(); err != nil {
+			return err
+		}
+		if names[c.Channels[i].Name] {
+			return fmt.Errorf("channel %s is defined more than once", c.Channels[i].Name)
+		}
+		names[c.Channels[i].Name] = true
+	}
+	for i := range c.Rules {
+		if err := c.Rules[i].validate(); err != nil {
+			return err
+		}
+	}
+	for _, version := range []string{c.LastWindowsXPVersion, c.LastOSXYosemiteVersion} {
+		if version == "" {
+			continue
+		}
+		if _, err := semver.Parse(version); err != nil {
+			return fmt.Errorf("bad last version %q for an old OS: %v", version, err)
+		}
+	}
+	if c.MinVersion != "" {
+		if _, err := semver.Parse(c.MinVersion); err != nil {
+			return fmt.Errorf("bad minimum version %q: %v", c.MinVersion, err)
+		}
+	}
+	for _, version := range c.PausedVersions {
+		if _, err := semver.Parse(version); err != nil {
+			return fmt.Errorf("bad paused version %q: %v", version, err)
+		}
+	}
+	for _, version := range c.BlockedVersions {
+		if _, err := semver.Parse(version); err != nil {
+			return fmt.Errorf("bad blocked version %q: %v", version, err)
+		}
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+	for version, limit := range c.ReleaseRateLimits {
+		if _, err := semver.Parse(version); err != nil {
+			return fmt.Errorf("bad rate limited version %q: %v", version, err)
+		}
+		if err := limit.validate(); err != nil {
+			return err
+		}
+	}
+	for version := range c.Activations {
+		if _, err := semver.Parse(version); err != nil {
+			return fmt.Errorf("bad activated version %q: %v", version, err)
+		}
+	}
+	for i := range c.UpdateWindows {
+		if err := c.UpdateWindows[i].validate(); err != nil {
+			return err
+		}
+	}
+	for i := range c.Rollbacks {
+		if err := c.Rollbacks[i].validate(); err != nil {
+			return err
+		}
+	}
+	for version, initiative := range c.Initiatives {
+		if _, err := semver.Parse(version); err != nil {
+			return fmt.Errorf("bad version %q: %v", version, err)
+		}
+		if err := initiative.validate(); err != nil {
+			return fmt.Errorf("bad initiative for %s: %v", version, err)
+		}
+	}
+	return nil
+}
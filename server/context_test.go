@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestCheckForUpdateContext(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	newReleaseManager := func() (*ReleaseManager, *Params) {
+		rm := newTestReleaseManager(t, "7.0.0", "7.1.0")
+		current, err := rm.lookupAssetWithVersion(OS.Linux, Arch.X64, "7.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rm, &Params{AppVersion: "7.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum}
+	}
+
+	rm, params := newReleaseManager()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rm.CheckForUpdate(ctx, params, false); err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("Expecting patch generation to stop once the client is gone, got %v", err)
+	}
+	rm.Stop()
+	if _, err := rm.CheckForUpdate(context.Background(), params, false); err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("Expecting patch generation to stop with the release manager, got %v", err)
+	}
+
+	rm, params = newReleaseManager()
+	ctx, root := tracer.Start(context.Background(), "request")
+	res, err := rm.CheckForUpdate(ctx, params, false)
+	root.End()
+	if err != nil || res.PatchType != PATCHTYPE_BSDIFF {
+		t.Fatalf("Expecting a patch, got %+v, %v", res, err)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			continue
+		}
+		spans[span.Name()] = span
+	}
+	for name, parent := range map[string]string{
+		"lookup":   "request",
+		"diff":     "request",
+		"download": "diff",
+	} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("Expecting a %s span, got %v", name, spans)
+		}
+		if span.Parent().SpanID() != spans[parent].SpanContext().SpanID() {
+			t.Errorf("Expecting %s to be a child of %s", name, parent)
+		}
+	}
+}
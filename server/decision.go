@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+// Decision traces how the update offered to a client was chosen.
+type Decision struct {
+	// DryRun evaluates the decision without generating patches or consuming
+	// rate limits.
+	DryRun bool `json:"dry_run"`
+
+	Channel  string `json:"channel"`
+	Cohort   string `json:"cohort,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	// MatchedRules are the names of all the rules matching the client, the
+	// first one applies.
+	MatchedRules []string `json:"matched_rules,omitempty"`
+	// Rollback is the version the client is rolled back to, if any.
+	Rollback string `json:"rollback,omitempty"`
+	// Latest is the latest release of the client's channel.
+	Latest string `json:"latest,omitempty"`
+	// Update is the asset offered to the client, if any.
+	Update *CatalogAsset `json:"update,omitempty"`
+	// Current is the asset matching the client's checksum, if any.
+	Current     *CatalogAsset `json:"current,omitempty"`
+	PatchType   PatchType     `json:"patch_type,omitempty"`
+	PatchName   string        `json:"patch_name,omitempty"`
+	PatchExists bool          `json:"patch_exists"`
+	// RateLimited is set if the rate limits would have suppressed the
+	// update, RetryAfter is how many seconds the client would have been
+	// asked to wait, as in the Retry-After header.
+	RateLimited bool  `json:"rate_limited"`
+	RetryAfter  int64 `json:"retry_after,omitempty"`
+
+	Result *Result `json:"result,omitempty"`
+	Error  string  `json:"error,omitempty"`
+	// Trace holds the steps of the decision in order.
+	Trace []string `json:"trace"`
+}
+
+func (d *Decision) tracef(format string, args ...any) {
+	d.Trace = append(d.Trace, fmt.Sprintf(format, args...))
+}
+
+// Evaluate returns the decision trace of the update the client would get,
+// without generating any patch or consuming rate limits. The params are left
+// untouched.
+func (g *ReleaseManager) Evaluate(ctx context.Context, p *Params, isLantern bool) *Decision {
+	params := *p
+	params.Tags = make(map[string]string, len(p.Tags))
+	for k, v := range p.Tags {
+		params.Tags[k] = v
+	}
+
+	d := &Decision{DryRun: true, Trace: []string{}}
+	res, err := g.decide(ctx, &params, isLantern, d)
+	if err != nil {
+		if err == ErrNoUpdateAvailable {
+			d.tracef("No update is available")
+		}
+		d.Error = err.Error()
+		return d
+	}
+	d.Result = res
+
+	if ok, wait := g.checkRateLimits(res); !ok {
+		d.RateLimited = true
+		d.RetryAfter = retryAfterSeconds(wait)
+		d.tracef("Rate limits would suppress the update for %v", wait)
+	}
+	return d
+}
+
+// ineligibility returns why the client can't get the given release, or an
+// empty string if it can.
+func ineligibility(cfg *AppConfig, channel *Channel, cohort string, clientID string, now time.Time, a *Asset) string {
+	switch {
+	case !channel.includes(a):
+		return fmt.Sprintf("not on channel %s", channel.Name)
+	case !cfg.isActive(a.v, now):
+		return fmt.Sprintf("not active until %v", cfg.Activations[a.v.String()])
+	case cfg.isBlocked(a):
+		return "blocked"
+	case cfg.isPaused(a.v):
+		return "paused"
+	case !cfg.inRolloutCohorts(a.v, cohort):
+		return fmt.Sprintf("not rolled out to cohort %q", cohort)
+	case !cfg.inRollout(a.v, clientID):
+		return fmt.Sprintf("client %q is not part of the %v%% rollout", clientID, cfg.rolloutPercentage(a.v))
+	}
+	return ""
+}
+
+// matchingRuleNames returns the names of all the rules matching the client.
+func (c *AppConfig) matchingRuleNames(p *Params, appVersion semver.Version, isLantern bool) []string {
+	var names []string
+	rules := c.rules(isLantern)
+	for i := range rules {
+		if rules[i].matches(p, appVersion) {
+			names = append(names, rules[i].Name)
+		}
+	}
+	return names
+}
+
+// findPatch returns a replacement for patchFor that only looks for existing
+// patches, recording whether they exist in d. Missing patches are reported
+// under the name they would be generated with.
+func (g *ReleaseManager) findPatch(d *Decision) func(ctx context.Context, current *Asset, update *Asset, patchType PatchType) (*PatchInfo, error) {
+	return func(ctx context.Context, current *Asset, update *Asset, patchType PatchType) (*PatchInfo, error) {
+		info, ok := g.patches.Find(current.Checksum, update.Checksum, patchType)
+		d.PatchExists = ok
+		if !ok {
+			info = &PatchInfo{Name: patchName(current.Checksum, update.Checksum, patchType), Type: patchType}
+		}
+		return info, nil
+	}
+}
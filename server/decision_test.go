@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	rm := newTestReleaseManager(t, "7.0.0", "7.1.0", "7.2.0")
+	rm.SetConfig(&AppConfig{
+		Rules: []Rule{{Name: "cap-linux", OS: OS.Linux, Action: RULEACTION_CAP, Version: "7.2.0"}},
+	})
+	rm.SetDefaultRateLimit(RateLimit{UpdatesPerSecond: 1})
+	if err := rm.PauseRelease("7.2.0", true); err != nil {
+		t.Fatal(err)
+	}
+	current, err := rm.lookupAssetWithVersion(OS.Linux, Arch.X64, "7.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update, err := rm.lookupAssetWithVersion(OS.Linux, Arch.X64, "7.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := &Params{AppVersion: "7.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum}
+	for i := 0; i < 3; i++ {
+		d := rm.Evaluate(context.Background(), params, false)
+		if d.Error != "" {
+			t.Fatalf("Unexpected error: %v", d.Error)
+		}
+		if d.RateLimited {
+			t.Fatalf("Evaluation %d should not consume rate limits", i)
+		}
+		if d.Update == nil || d.Update.Checksum != update.Checksum || d.Current == nil || d.Current.Version != "7.0.0" {
+			t.Fatalf("Unexpected update %+v from %+v", d.Update, d.Current)
+		}
+		if len(d.MatchedRules) != 1 || d.MatchedRules[0] != "cap-linux" {
+			t.Fatalf("Unexpected matched rules %v", d.MatchedRules)
+		}
+		if d.PatchExists || d.PatchType != PATCHTYPE_BSDIFF || d.PatchName != patchName(current.Checksum, update.Checksum, PATCHTYPE_BSDIFF) {
+			t.Fatalf("Unexpected patch %v %v %v", d.PatchName, d.PatchType, d.PatchExists)
+		}
+	}
+	if _, ok := rm.Patches().Find(current.Checksum, update.Checksum, PATCHTYPE_BSDIFF); ok {
+		t.Fatal("Evaluations should not generate patches")
+	}
+
+	if ok, _ := rm.allowUpdate(&Result{Version: "7.1.0"}); !ok {
+		t.Fatal("The first update should be allowed")
+	}
+	if d := rm.Evaluate(context.Background(), params, false); !d.RateLimited || d.RetryAfter <= 0 {
+		t.Fatalf("Evaluation should report the rate limit, got %+v", d)
+	}
+
+	d := rm.Evaluate(context.Background(), &Params{AppVersion: "7.1.0", OS: OS.Linux, Arch: Arch.X64, Checksum: "?"}, false)
+	if d.Error != ErrNoUpdateAvailable.Error() || d.Update != nil {
+		t.Fatalf("Expecting no update, got %+v", d)
+	}
+	if !strings.Contains(strings.Join(d.Trace, "\n"), "Release 7.1.0 is not newer than 7.1.0") {
+		t.Fatalf("Unexpected trace %q", d.Trace)
+	}
+
+	rm.SetConfig(&AppConfig{
+		PausedVersions: []string{"7.2.0"},
+		Rollouts:       []Rollout{{Version: "7.1.0", Percentage: 0}},
+	})
+	d = rm.Evaluate(context.Background(), &Params{AppVersion: "7.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: "?"}, false)
+	trace := strings.Join(d.Trace, "\n")
+	if !strings.Contains(trace, "Latest release 7.2.0 is not offered: paused") {
+		t.Fatalf("Expecting the paused release in the trace, got %q", d.Trace)
+	}
+	if d.Update != nil || !strings.Contains(trace, "Release 7.0.0 is not newer than 7.0.0") {
+		t.Fatalf("Expecting the rollout to hold the update back, got %q", d.Trace)
+	}
+}
+
+func TestAdminEvaluate(t *testing.T) {
+	rm := newTestReleaseManager(t, "7.1.0")
+
+	u := NewUpdateServer("http://127.0.0.1:9999/", "127.0.0.1:0", ".", 0)
+	u.apps["lantern"] = rm
+	srv := httptest.NewServer(u.AdminHandler("secret"))
+	defer srv.Close()
+
+	body, _ := json.Marshal(map[string]any{
+		"app_version": "7.0.0",
+		"os":          OS.Linux,
+		"arch":        Arch.X64,
+		"checksum":    "?",
+	})
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/evaluate?app=lantern", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting 200 OK, got %s", res.Status)
+	}
+	var d Decision
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+	if !d.DryRun || d.Result == nil || d.Result.Version != "7.1.0" || d.Result.PatchURL != "" || len(d.Trace) == 0 {
+		t.Fatalf("Unexpected decision %+v", d)
+	}
+}
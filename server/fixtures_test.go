@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+// newTestReleaseManager returns a release manager of getlantern/lantern with
+// a linux/amd64 update asset for each of the given versions.
+func newTestReleaseManager(t *testing.T, versions ...string) *ReleaseManager {
+	t.Helper()
+	rm := NewReleaseManager("getlantern", "lantern")
+	for _, version := range versions {
+		pushTestAsset(t, rm, OS.Linux, Arch.X64, version)
+	}
+	return rm
+}
+
+// pushTestAsset adds an update asset of the given version to rm. Versions
+// with a prerelease part are pushed as Github prereleases. Asset URLs are
+// unique to the test, so that tests don't share cached assets and patches.
+func pushTestAsset(t *testing.T, rm *ReleaseManager, os string, arch string, version string) *Asset {
+	t.Helper()
+	v := semver.MustParse(version)
+	asset := &Asset{
+		URL:        "https://github.com/" + rm.owner + "/" + rm.repo + "/releases/download/" + version + "/update_" + os + "_" + arch + "_" + t.Name(),
+		v:          v,
+		Tag:        version,
+		Prerelease: len(v.Pre) > 0,
+	}
+	if err := rm.pushAsset(context.Background(), os, arch, asset); err != nil {
+		t.Fatalf("Could not push asset: %v", err)
+	}
+	return asset
+}
+
+// testParams returns the parameters of a linux/amd64 client running the given
+// version, without a known checksum.
+func testParams(appVersion string) *Params {
+	return &Params{AppVersion: appVersion, OS: OS.Linux, Arch: Arch.X64, Checksum: "?"}
+}
+
+// expectUpdate checks that rm offers the expected version to the client, or
+// no update at all if expected is empty.
+func expectUpdate(t *testing.T, rm *ReleaseManager, params *Params, expected string) *Result {
+	t.Helper()
+	r, err := rm.CheckForUpdate(context.Background(), params, false)
+	if expected == "" {
+		if err != ErrNoUpdateAvailable {
+			t.Fatalf("Expecting no update for %s with tags %v, got %v, %v", params.AppVersion, params.Tags, r, err)
+		}
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("CheckForUpdate for %s with tags %v: %v", params.AppVersion, params.Tags, err)
+	}
+	if r.Version != expected {
+		t.Fatalf("Expecting %s for %s with tags %v, got %s", expected, params.AppVersion, params.Tags, r.Version)
+	}
+	return r
+}
@@ -7,6 +7,8 @@ import (
 	"regexp"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/blang/semver"
 	"github.com/google/go-github/github"
@@ -44,10 +46,12 @@ var OS = struct {
 
 // Release struct represents a single github release.
 type Release struct {
-	id      int64
-	URL     string
-	Version semver.Version // Release version.
-	Assets  []Asset        // The list of assets on this release.
+	id         int64
+	URL        string
+	Tag        string         // Name of the Github tag of the release.
+	Version    semver.Version // Release version.
+	Prerelease bool           // Whether the release is marked as a prerelease on Github.
+	Assets     []Asset        // The list of assets on this release.
 }
 
 type releasesByID []Release
@@ -59,8 +63,13 @@ type Asset struct {
 	Name      string // Name of the release.
 	URL       string // URL of the patch.
 	LocalFile string
-	Checksum  string // SHA256 hash of the file.
-	Signature string // RSASSA-PKCS1-V1_5-SIGN signature, this is the SHA256 hash against the private key.
+	Checksum  string      // SHA256 hash of the file.
+	Signature string      // RSASSA-PKCS1-V1_5-SIGN signature, this is the SHA256 hash against the private key.
+	Format    AssetFormat // How the contents of the asset are packaged.
+	Tag       string      // Github tag of the release of the asset.
+	// Prerelease is set if the asset belongs to a prerelease, which is only
+	// offered on release channels other than stable.
+	Prerelease bool
 	AssetInfo
 }
 
@@ -76,8 +85,29 @@ type ReleaseManager struct {
 	owner           string
 	repo            string
 	updateAssetsMap map[string]map[string]map[string]*Asset
-	latestAssetsMap map[string]map[string]*Asset
-	mu              *sync.RWMutex
+	latestAssetsMap map[string]map[string]*Asset // Latest stable assets.
+	// Latest assets of each release channel other than stable.
+	channelAssetsMap map[string]map[string]map[string]*Asset
+	patches          *PatchStore
+	storage          PatchStorage
+	publicAddr       string
+	// config holds the settings in effect, configured is what they were
+	// set to before applying the overrides made at runtime.
+	config           atomic.Pointer[AppConfig]
+	configured       *AppConfig
+	overrides        releaseOverrides
+	limiter          *rateLimiter
+	defaultRateLimit atomic.Pointer[RateLimit]
+	now              func() time.Time
+	refreshedAt      time.Time // Last successful refresh of the releases.
+	refreshMu        sync.Mutex
+	mu               *sync.RWMutex
+	// requests counts the update requests being handled, see retire.
+	requests sync.WaitGroup
+	// ctx is cancelled by Stop to abort the downloads, patch generations and
+	// refreshes in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (a releasesByID) Len() int {
@@ -96,14 +126,22 @@ func (a releasesByID) Less(i, j int) bool {
 func NewReleaseManager(owner string, repo string) *ReleaseManager {
 
 	ghc := &ReleaseManager{
-		client:          github.NewClient(nil),
-		owner:           owner,
-		repo:            repo,
-		mu:              new(sync.RWMutex),
-		updateAssetsMap: make(map[string]map[string]map[string]*Asset),
-		latestAssetsMap: make(map[string]map[string]*Asset),
+		client:           github.NewClient(nil),
+		owner:            owner,
+		repo:             repo,
+		mu:               new(sync.RWMutex),
+		patches:          patchStore,
+		storage:          &LocalPatchStorage{},
+		limiter:          newRateLimiter(),
+		updateAssetsMap:  make(map[string]map[string]map[string]*Asset),
+		latestAssetsMap:  make(map[string]map[string]*Asset),
+		channelAssetsMap: make(map[string]map[string]map[string]*Asset),
 	}
 
+	ghc.configured = &AppConfig{}
+	ghc.config.Store(ghc.configured)
+	ghc.ctx, ghc.cancel = context.WithCancel(context.Background())
+
 	if mockServerAddr != "" {
 		uri, err := url.Parse("http://" + mockServerAddr)
 		if err != nil {
@@ -117,14 +155,70 @@ func NewReleaseManager(owner string, repo string) *ReleaseManager {
 	return ghc
 }
 
+// assetCount returns the number of update assets known. g.mu must be held.
+func (g *ReleaseManager) assetCount() int {
+	n := 0
+	for _, arches := range g.updateAssetsMap {
+		for _, assets := range arches {
+			n += len(assets)
+		}
+	}
+	return n
+}
+
+// Stop aborts the downloads, patch generations and refreshes in progress, and
+// any started later on.
+func (g *ReleaseManager) Stop() {
+	g.cancel()
+}
+
+// Patches returns the store holding the patches generated by this release
+// manager.
+func (g *ReleaseManager) Patches() *PatchStore {
+	return g.patches
+}
+
+// SetPatchStorage sets where generated patches are published. Patches are
+// served from the local patches directory by default.
+func (g *ReleaseManager) SetPatchStorage(storage PatchStorage) {
+	g.storage = storage
+}
+
+// SetPublicAddr sets the public address of the update server, used to build
+// URLs of assets served locally.
+func (g *ReleaseManager) SetPublicAddr(publicAddr string) {
+	g.publicAddr = publicAddr
+}
+
+// SetConfig replaces the settings of the app served by this release manager.
+// It's safe to call it while serving requests. Pauses and rollbacks made with
+// PauseRelease and SetRollback still apply on top of the new settings.
+func (g *ReleaseManager) SetConfig(cfg *AppConfig) {
+	if cfg == nil {
+		cfg = &AppConfig{}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.configured = cfg
+	g.config.Store(g.overrides.apply(cfg))
+	g.indexLatestAssets()
+	g.pruneRateLimits()
+}
+
+// Config returns the current settings of the app served by this release
+// manager.
+func (g *ReleaseManager) Config() *AppConfig {
+	return g.config.Load()
+}
+
 // getReleases queries github for all product releases.
-func (g *ReleaseManager) getReleases() ([]Release, error) {
+func (g *ReleaseManager) getReleases(ctx context.Context) ([]Release, error) {
 	releases := []Release{}
 
 	for page := 1; true; page++ {
 		opt := &github.ListOptions{Page: page}
 
-		rels, _, err := g.client.Repositories.ListReleases(context.Background(), g.owner, g.repo, opt)
+		rels, _, err := g.client.Repositories.ListReleases(ctx, g.owner, g.repo, opt)
 		if err != nil {
 			return nil, err
 		}
@@ -133,6 +227,10 @@ func (g *ReleaseManager) getReleases() ([]Release, error) {
 		}
 
 		for i := range rels {
+			if rels[i].GetDraft() {
+				log.Debugf("Ignoring draft release %s", rels[i].GetTagName())
+				continue
+			}
 			version := *rels[i].TagName
 			v, err := semver.Parse(version)
 			if err != nil {
@@ -144,9 +242,11 @@ func (g *ReleaseManager) getReleases() ([]Release, error) {
 				continue
 			}
 			rel := Release{
-				id:      *rels[i].ID,
-				URL:     *rels[i].ZipballURL,
-				Version: v,
+				id:         *rels[i].ID,
+				URL:        *rels[i].ZipballURL,
+				Tag:        version,
+				Version:    v,
+				Prerelease: rels[i].GetPrerelease(),
 			}
 			rel.Assets = make([]Asset, 0, len(rels[i].Assets))
 			for _, asset := range rels[i].Assets {
@@ -166,13 +266,27 @@ func (g *ReleaseManager) getReleases() ([]Release, error) {
 }
 
 // UpdateAssetsMap will pull published releases, scan for compatible
-// update-only binaries and will add them to the updateAssetsMap.
-func (g *ReleaseManager) UpdateAssetsMap() (err error) {
+// update-only binaries and will add them to the updateAssetsMap. It gives up
+// once ctx is done or the release manager is stopped.
+func (g *ReleaseManager) UpdateAssetsMap(ctx context.Context) (err error) {
+	g.refreshMu.Lock()
+	defer g.refreshMu.Unlock()
+	ctx, cancel := g.withLifetime(ctx)
+	defer cancel()
+
+	repo := g.owner + "/" + g.repo
+	start := time.Now()
+	defer func() {
+		assetRefreshSeconds.WithLabelValues(repo).Observe(time.Since(start).Seconds())
+		if err != nil {
+			assetRefreshFailures.WithLabelValues(repo).Inc()
+		}
+	}()
 
 	var rs []Release
 
 	log.Debugf("Getting releases...")
-	if rs, err = g.getReleases(); err != nil {
+	if rs, err = g.getReleases(ctx); err != nil {
 		return err
 	}
 	log.Debugf("Found %d releases under %s/%s", len(rs), g.owner, g.repo)
@@ -192,11 +306,13 @@ func (g *ReleaseManager) UpdateAssetsMap() (err error) {
 				log.Debugf("%q/%v is an auto-update asset.", rs[i].Assets[j].Name, rs[i].Assets[j].v.Major)
 				asset := rs[i].Assets[j]
 				asset.v = rs[i].Version
+				asset.Tag = rs[i].Tag
+				asset.Prerelease = rs[i].Prerelease
 				info, err := getAssetInfo(asset.Name)
 				if err != nil {
 					return fmt.Errorf("could not get asset info: %q", err)
 				}
-				if err = g.pushAsset(info.OS, info.Arch, &asset); err != nil {
+				if err = g.pushAsset(ctx, info.OS, info.Arch, &asset); err != nil {
 					return fmt.Errorf("could not push asset: %q", err)
 				}
 			} else {
@@ -205,26 +321,69 @@ func (g *ReleaseManager) UpdateAssetsMap() (err error) {
 		}
 	}
 
+	g.mu.Lock()
+	g.refreshedAt = g.clock()
+	assets := g.assetCount()
+	g.pruneRateLimits()
+	g.mu.Unlock()
+	catalogAssets.WithLabelValues(repo).Set(float64(assets))
+
 	return nil
 }
 
-func (g *ReleaseManager) getProductUpdate(os string, arch string) (asset *Asset, err error) {
+func (g *ReleaseManager) getProductUpdate(channel string, os string, arch string) (asset *Asset, err error) {
 	g.mu.RLock()
 	defer g.mu.RUnlock()
 
-	if g.latestAssetsMap == nil {
+	latestAssetsMap := g.latestAssetsMap
+	if channel != CHANNEL_STABLE {
+		latestAssetsMap = g.channelAssetsMap[channel]
+	}
+
+	if latestAssetsMap == nil {
+		if channel != CHANNEL_STABLE {
+			// Channels may not have any release yet.
+			return nil, ErrNoUpdateAvailable
+		}
 		return nil, fmt.Errorf("no updates available")
 	}
 
-	if g.latestAssetsMap[os] == nil {
+	if latestAssetsMap[os] == nil {
 		return nil, fmt.Errorf("no such OS")
 	}
 
-	if g.latestAssetsMap[os][arch] == nil {
+	if latestAssetsMap[os][arch] == nil {
 		return nil, fmt.Errorf("no such Arch")
 	}
 
-	return g.latestAssetsMap[os][arch], nil
+	return latestAssetsMap[os][arch], nil
+}
+
+// lookupLatestAsset returns the newest asset for the given OS and arch that
+// is accepted by the given function.
+func (g *ReleaseManager) lookupLatestAsset(os string, arch string, accept func(*Asset) bool) (asset *Asset, err error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.updateAssetsMap[os] == nil {
+		return nil, fmt.Errorf("no such OS")
+	}
+
+	if g.updateAssetsMap[os][arch] == nil {
+		return nil, fmt.Errorf("no such Arch")
+	}
+
+	for _, a := range g.updateAssetsMap[os][arch] {
+		if accept(a) && (asset == nil || a.v.GT(asset.v)) {
+			asset = a
+		}
+	}
+
+	if asset == nil {
+		return nil, fmt.Errorf("no matching assets")
+	}
+
+	return asset, nil
 }
 
 func (g *ReleaseManager) lookupAssetWithChecksum(os string, arch string, checksum string) (asset *Asset, err error) {
@@ -256,6 +415,24 @@ func (g *ReleaseManager) lookupAssetWithChecksum(os string, arch string, checksu
 	return nil, fmt.Errorf("could not find a matching checksum in assets list")
 }
 
+// lookupCachedAsset looks for an asset with the given checksum, regardless of
+// its OS and arch.
+func (g *ReleaseManager) lookupCachedAsset(checksum string) *Asset {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
+			for _, a := range g.updateAssetsMap[os][arch] {
+				if a.Checksum == checksum && a.LocalFile != "" {
+					return a
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (g *ReleaseManager) lookupAssetWithVersion(os string, arch string, version string) (asset *Asset, err error) {
 	g.mu.RLock()
 	defer g.mu.RUnlock()
@@ -281,10 +458,10 @@ func (g *ReleaseManager) lookupAssetWithVersion(os string, arch string, version
 	return nil, fmt.Errorf("could not find a matching version in assets list")
 }
 
-func (g *ReleaseManager) pushAsset(os string, arch string, asset *Asset) (err error) {
-	g.mu.Lock()
-	defer g.mu.Unlock()
-
+// pushAsset downloads the given asset and adds it to the assets served. The
+// download happens without holding g.mu, so that settings can change and
+// clients be served meanwhile.
+func (g *ReleaseManager) pushAsset(ctx context.Context, os string, arch string, asset *Asset) (err error) {
 	version := asset.v
 
 	asset.OS = os
@@ -295,10 +472,12 @@ func (g *ReleaseManager) pushAsset(os string, arch string, asset *Asset) (err er
 	}
 
 	var localfile string
-	if localfile, err = downloadAsset(asset.URL); err != nil {
+	if localfile, err = downloadAsset(ctx, asset.URL); err != nil {
 		return err
 	}
 
+	asset.LocalFile = localfile
+
 	if asset.Checksum, err = checksumForFile(localfile); err != nil {
 		return err
 	}
@@ -307,6 +486,13 @@ func (g *ReleaseManager) pushAsset(os string, arch string, asset *Asset) (err er
 		return err
 	}
 
+	if asset.Format, err = detectAssetFormat(asset.URL, localfile); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
 	// Pushing version.
 	if g.updateAssetsMap[os] == nil {
 		g.updateAssetsMap[os] = make(map[string]map[string]*Asset)
@@ -317,20 +503,68 @@ func (g *ReleaseManager) pushAsset(os string, arch string, asset *Asset) (err er
 	g.updateAssetsMap[os][arch][version.String()] = asset
 
 	// Setting latest version.
-	if g.latestAssetsMap[os] == nil {
-		g.latestAssetsMap[os] = make(map[string]*Asset)
+	g.indexLatestAsset(asset)
+
+	return nil
+}
+
+// setLatestAsset records asset in latestAssetsMap if it's newer than the one
+// already there.
+func setLatestAsset(latestAssetsMap map[string]map[string]*Asset, asset *Asset) {
+	os, arch := asset.OS, asset.Arch
+	if latestAssetsMap[os] == nil {
+		latestAssetsMap[os] = make(map[string]*Asset)
 	}
 
-	if g.latestAssetsMap[os][arch] == nil {
-		g.latestAssetsMap[os][arch] = asset
+	if latestAssetsMap[os][arch] == nil {
+		latestAssetsMap[os][arch] = asset
 	} else {
 		// Compare against already set version.
-		if asset.v.GT(g.latestAssetsMap[os][arch].v) {
-			g.latestAssetsMap[os][arch] = asset
+		if asset.v.GT(latestAssetsMap[os][arch].v) {
+			latestAssetsMap[os][arch] = asset
 		}
 	}
+}
 
-	return nil
+// indexLatestAsset records asset as the latest one of the channels it
+// belongs to, if it's newer. Blocked assets are skipped so that the next best
+// release is offered instead. It must be called with g.mu held.
+func (g *ReleaseManager) indexLatestAsset(asset *Asset) {
+	cfg := g.Config()
+	if cfg.isBlocked(asset) {
+		log.Debugf("Not offering blocked asset %s %s/%s (%s)", asset.v, asset.OS, asset.Arch, asset.Checksum)
+		return
+	}
+
+	if stableChannel.includes(asset) {
+		setLatestAsset(g.latestAssetsMap, asset)
+	}
+
+	channels := cfg.channels()
+	for i := range channels {
+		if !channels[i].includes(asset) {
+			continue
+		}
+		name := channels[i].Name
+		if g.channelAssetsMap[name] == nil {
+			g.channelAssetsMap[name] = make(map[string]map[string]*Asset)
+		}
+		setLatestAsset(g.channelAssetsMap[name], asset)
+	}
+}
+
+// indexLatestAssets rebuilds the latest assets of every channel, after the
+// channels or the blocklist changed. It must be called with g.mu held.
+func (g *ReleaseManager) indexLatestAssets() {
+	g.latestAssetsMap = make(map[string]map[string]*Asset)
+	g.channelAssetsMap = make(map[string]map[string]map[string]*Asset)
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
+			for _, a := range g.updateAssetsMap[os][arch] {
+				g.indexLatestAsset(a)
+			}
+		}
+	}
 }
 
 func getAssetInfo(s string) (*AssetInfo, error) {
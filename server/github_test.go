@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
@@ -67,7 +68,7 @@ func getOrCreateTestClient(t *testing.T) *ReleaseManager {
 		if testClient == nil {
 			t.Fatal("Failed to create new client.")
 		}
-		if err := testClient.UpdateAssetsMap(); err != nil {
+		if err := testClient.UpdateAssetsMap(context.Background()); err != nil {
 			t.Fatalf("Failed to update assets map: %v", err)
 		}
 	}
@@ -147,18 +148,18 @@ func TestDownloadOldestVersionAndUpgradeIt(t *testing.T) {
 			}
 
 			// Generate a binary diff of the two assets.
-			if p, err = generatePatch(asset.URL, newAsset.URL); err != nil {
+			if p, err = generatePatch(context.Background(), asset.URL, newAsset.URL); err != nil {
 				t.Fatalf("Unable to generate patch: %v", err)
 			}
 
 			// Apply patch.
 			var oldAssetFile string
-			if oldAssetFile, err = downloadAsset(asset.URL); err != nil {
+			if oldAssetFile, err = downloadAsset(context.Background(), asset.URL); err != nil {
 				t.Fatal(err)
 			}
 
 			var newAssetFile string
-			if newAssetFile, err = downloadAsset(newAsset.URL); err != nil {
+			if newAssetFile, err = downloadAsset(context.Background(), newAsset.URL); err != nil {
 				t.Fatal(err)
 			}
 
@@ -223,7 +224,7 @@ func TestDownloadOldestVersionAndUpgradeIt(t *testing.T) {
 				Checksum:   asset.Checksum,
 			}
 
-			r, err := testClient.CheckForUpdate(&params, true)
+			r, err := testClient.CheckForUpdate(context.Background(), &params, true)
 			if err != nil {
 				if err == ErrNoUpdateAvailable {
 					// That's OK, let's make sure.
@@ -257,7 +258,7 @@ func TestDownloadOldestVersionAndUpgradeIt(t *testing.T) {
 				Checksum:   "?",
 			}
 
-			r, err := testClient.CheckForUpdate(&params, true)
+			r, err := testClient.CheckForUpdate(context.Background(), &params, true)
 			if err != nil {
 				if err == ErrNoUpdateAvailable {
 					// That's OK, let's make sure.
@@ -283,15 +284,16 @@ func TestDownloadOldestVersionAndUpgradeIt(t *testing.T) {
 
 func TestCheckOsVersion(t *testing.T) {
 	testClient := getOrCreateTestClient(t)
+	defer testClient.SetConfig(testClient.Config())
 	// change to a version present on GitHub
-	lastLanternVersionForWindowsXP = "5.3.4"
-	lastLanternVersionForOSXYosemite = "5.3.1"
+	lastVersionForWindowsXP, lastVersionForOSXYosemite := "5.3.4", "5.3.1"
+	testClient.SetConfig(&AppConfig{LastWindowsXPVersion: lastVersionForWindowsXP, LastOSXYosemiteVersion: lastVersionForOSXYosemite})
 	osVersionWindowsXP := "5.1.0"
 	osVersionOSXYosemite := "14.4.1"
 	for _, fields := range [][]string{
-		[]string{osVersionWindowsXP, "windows", "386", "3.7.0", lastLanternVersionForWindowsXP},
+		[]string{osVersionWindowsXP, "windows", "386", "3.7.0", lastVersionForWindowsXP},
 		[]string{osVersionWindowsXP, "windows", "386", "9.9.9", ""},
-		[]string{osVersionOSXYosemite, "darwin", "amd64", "3.7.0", lastLanternVersionForOSXYosemite},
+		[]string{osVersionOSXYosemite, "darwin", "amd64", "3.7.0", lastVersionForOSXYosemite},
 		[]string{osVersionOSXYosemite, "darwin", "amd64", "9.9.9", ""},
 		[]string{"", "android", "arm", "9.9.9", ""},
 		[]string{"", "android", "arm64", "9.9.9", ""},
@@ -304,7 +306,7 @@ func TestCheckOsVersion(t *testing.T) {
 			Checksum:   "fake",
 		}
 		versionString := fmt.Sprintf("%s(%s%s/%s)", params.AppVersion, params.OS, params.OSVersion, params.Arch)
-		r, err := testClient.CheckForUpdate(&params, true)
+		r, err := testClient.CheckForUpdate(context.Background(), &params, true)
 		if err == nil {
 			if r.Version != fields[4] {
 				t.Fatalf("Expecting %s for %s, got %s", fields[4], versionString, r.Version)
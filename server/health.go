@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	// Catalogs older than this make the server degraded, that is after a
+	// couple of refreshes failed in a row.
+	defaultCatalogMaxAge = 3 * githubRefreshTime
+)
+
+// Readiness statuses reported by /readyz.
+const (
+	READINESS_READY         = "ready"
+	READINESS_DEGRADED      = "degraded"
+	READINESS_NOT_READY     = "not_ready"
+	READINESS_SHUTTING_DOWN = "shutting_down"
+)
+
+// Readiness is the body of /readyz.
+type Readiness struct {
+	Status string                   `json:"status"`
+	Apps   map[string]*AppReadiness `json:"apps"`
+}
+
+// AppReadiness describes the catalog of an app served.
+type AppReadiness struct {
+	Repo        string     `json:"repo"`
+	Status      string     `json:"status"`
+	RefreshedAt *time.Time `json:"refreshed_at,omitempty"`
+	// Age is how long ago the catalog was refreshed, in seconds.
+	Age    float64 `json:"age,omitempty"`
+	Assets int     `json:"assets"`
+}
+
+// SetCatalogMaxAge sets how old the catalog of an app can get before /readyz
+// reports the server as degraded.
+func (u *UpdateServer) SetCatalogMaxAge(maxAge time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.catalogMaxAge = maxAge
+}
+
+// readiness reports whether every app served has a catalog, and whether any
+// is stale.
+func (u *UpdateServer) readiness() *Readiness {
+	u.mu.RLock()
+	closing, maxAge := u.closing, u.catalogMaxAge
+	u.mu.RUnlock()
+
+	r := &Readiness{Status: READINESS_READY, Apps: make(map[string]*AppReadiness)}
+	for name, rm := range u.releaseManagers() {
+		rm.mu.RLock()
+		refreshedAt, assets := rm.refreshedAt, rm.assetCount()
+		rm.mu.RUnlock()
+
+		app := &AppReadiness{Repo: rm.owner + "/" + rm.repo, Status: READINESS_READY, Assets: assets}
+		switch {
+		case refreshedAt.IsZero():
+			app.Status = READINESS_NOT_READY
+			r.Status = READINESS_NOT_READY
+		default:
+			app.RefreshedAt = &refreshedAt
+			age := rm.clock().Sub(refreshedAt)
+			app.Age = age.Seconds()
+			if age > maxAge {
+				app.Status = READINESS_DEGRADED
+				if r.Status == READINESS_READY {
+					r.Status = READINESS_DEGRADED
+				}
+			}
+		}
+		r.Apps[name] = app
+	}
+	if len(r.Apps) == 0 {
+		r.Status = READINESS_NOT_READY
+	}
+	if closing {
+		r.Status = READINESS_SHUTTING_DOWN
+	}
+	return r
+}
+
+// refreshed tells whether the releases were fetched at least once.
+func (g *ReleaseManager) refreshed() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return !g.refreshedAt.IsZero()
+}
+
+// healthzHandler tells whether the process is alive.
+func healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"status": "ok"})
+	})
+}
+
+// readyzHandler tells whether the server can take update requests. It fails
+// until every app has a catalog and once the server is shutting down. Stale
+// catalogs are reported as degraded but don't fail the probe, the server can
+// still serve the releases it knows about.
+func (u *UpdateServer) readyzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readiness := u.readiness()
+		if readiness.Status == READINESS_NOT_READY || readiness.Status == READINESS_SHUTTING_DOWN {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			writeJSON(w, readiness)
+			return
+		}
+		writeJSON(w, readiness)
+	})
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	u := NewUpdateServer("http://127.0.0.1:9999/", "127.0.0.1:0", ".", 0)
+	u.newReleaseManager = newTestReleaseManagers(t)
+	defer u.Close()
+
+	probe := func(path string, expected int) *Readiness {
+		t.Helper()
+		w := httptest.NewRecorder()
+		u.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != expected {
+			t.Fatalf("Expecting %d from %s, got %d", expected, path, w.Code)
+		}
+		var r Readiness
+		if err := json.NewDecoder(w.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		return &r
+	}
+
+	probe(healthzPath, http.StatusOK)
+	if r := probe(readyzPath, http.StatusServiceUnavailable); r.Status != READINESS_NOT_READY {
+		t.Fatalf("Expecting a server without apps not to be ready, got %s", r.Status)
+	}
+
+	if err := u.AddApp("lantern", &App{Source: "getlantern/lantern"}); err != nil {
+		t.Fatal(err)
+	}
+	r := probe(readyzPath, http.StatusOK)
+	if app := r.Apps["lantern"]; r.Status != READINESS_READY || app == nil || app.Status != READINESS_READY || app.Repo != "getlantern/lantern" || app.RefreshedAt == nil {
+		t.Fatalf("Expecting lantern to be ready, got %+v", r)
+	}
+
+	rm, _ := u.app("lantern")
+	rm.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	r = probe(readyzPath, http.StatusOK)
+	if r.Status != READINESS_DEGRADED || r.Apps["lantern"].Status != READINESS_DEGRADED || r.Apps["lantern"].Age < 7200 {
+		t.Fatalf("Expecting a stale catalog to degrade the server, got %+v", r.Apps["lantern"])
+	}
+	u.SetCatalogMaxAge(3 * time.Hour)
+	if r = probe(readyzPath, http.StatusOK); r.Status != READINESS_READY {
+		t.Fatalf("Expecting the catalog to be fresh enough, got %s", r.Status)
+	}
+
+	u.mu.Lock()
+	u.apps["beam"] = NewReleaseManager("xiaoshoudian", "xiazai")
+	u.mu.Unlock()
+	r = probe(readyzPath, http.StatusServiceUnavailable)
+	if r.Status != READINESS_NOT_READY || r.Apps["beam"].Status != READINESS_NOT_READY || r.Apps["lantern"].Status != READINESS_READY {
+		t.Fatalf("Expecting an app without catalog to make the server not ready, got %+v", r)
+	}
+
+	if err := u.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r = probe(readyzPath, http.StatusServiceUnavailable); r.Status != READINESS_SHUTTING_DOWN {
+		t.Fatalf("Expecting the server to report shutting down, got %s", r.Status)
+	}
+}
+
+func TestReadinessBeforeFirstRefresh(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+	released := false
+	defer func() {
+		if !released {
+			close(release)
+		}
+	}()
+	baseURL, _ := url.Parse(srv.URL + "/")
+
+	u := NewUpdateServer("http://127.0.0.1:9999/", "127.0.0.1:0", ".", 0)
+	u.newReleaseManager = func(owner string, repo string) *ReleaseManager {
+		rm := NewReleaseManager(owner, repo)
+		rm.client.BaseURL = baseURL
+		return rm
+	}
+	defer u.Close()
+
+	status := func(path string) (int, *Readiness) {
+		w := httptest.NewRecorder()
+		u.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var r Readiness
+		_ = json.NewDecoder(w.Body).Decode(&r)
+		return w.Code, &r
+	}
+
+	if err := u.ApplyInitialConfig(&Config{Apps: map[string]*App{"lantern": {Source: "getlantern/lantern"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := status(healthzPath); code != http.StatusOK {
+		t.Fatalf("Expecting the server to be alive while fetching releases, got %d", code)
+	}
+	code, r := status(readyzPath)
+	if code != http.StatusServiceUnavailable || r.Apps["lantern"] == nil || r.Apps["lantern"].Status != READINESS_NOT_READY {
+		t.Fatalf("Expecting lantern not to be ready before its releases are fetched, got %d %+v", code, r)
+	}
+
+	close(release)
+	released = true
+	for i := 0; ; i++ {
+		if code, _ = status(readyzPath); code == http.StatusOK {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Expecting the server to be ready once the releases are fetched, got %d", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/blang/semver"
+)
+
+func (i Initiative) validate() error {
+	switch i {
+	case INITIATIVE_AUTO, INITIATIVE_MANUAL, INITIATIVE_NEVER:
+		return nil
+	}
+	return fmt.Errorf("unknown initiative %q", i)
+}
+
+// initiative decides how the client should apply the given update: the
+// initiative configured for the release, unless a rule overrides it. Clients
+// below the minimum supported version always get a mandatory automatic
+// update.
+func (c *AppConfig) initiative(rule *Rule, update semver.Version, appVersion semver.Version) (initiative Initiative, mandatory bool) {
+	initiative = INITIATIVE_AUTO
+	if i, ok := c.Initiatives[update.String()]; ok {
+		initiative = i
+	}
+	if rule != nil && rule.Initiative != "" {
+		initiative = rule.Initiative
+	}
+	if c.MinVersion != "" {
+		if minVersion, err := semver.Parse(c.MinVersion); err == nil && appVersion.LT(minVersion) {
+			return INITIATIVE_AUTO, true
+		}
+	}
+	return initiative, false
+}
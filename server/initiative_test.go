@@ -0,0 +1,64 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func TestInitiative(t *testing.T) {
+	cfg := &AppConfig{
+		MinVersion: "6.0.0",
+		Initiatives: map[string]Initiative{
+			"7.1.0": INITIATIVE_MANUAL,
+			"7.2.0": INITIATIVE_NEVER,
+		},
+	}
+	manualRule := &Rule{Action: RULEACTION_INITIATIVE, Initiative: INITIATIVE_MANUAL}
+
+	for _, test := range []struct {
+		rule       *Rule
+		update     string
+		appVersion string
+		initiative Initiative
+		mandatory  bool
+	}{
+		{nil, "7.0.0", "6.5.0", INITIATIVE_AUTO, false},
+		{nil, "7.1.0", "6.5.0", INITIATIVE_MANUAL, false},
+		{nil, "7.2.0", "6.5.0", INITIATIVE_NEVER, false},
+		{manualRule, "7.0.0", "6.5.0", INITIATIVE_MANUAL, false},
+		{nil, "7.2.0", "5.0.0", INITIATIVE_AUTO, true},
+		{manualRule, "7.0.0", "5.0.0", INITIATIVE_AUTO, true},
+	} {
+		initiative, mandatory := cfg.initiative(test.rule, semver.MustParse(test.update), semver.MustParse(test.appVersion))
+		if initiative != test.initiative || mandatory != test.mandatory {
+			t.Fatalf("Expecting %s (mandatory: %v) for %s to %s, got %s (mandatory: %v)",
+				test.initiative, test.mandatory, test.appVersion, test.update, initiative, mandatory)
+		}
+	}
+
+	for _, bad := range []*AppConfig{
+		{MinVersion: "six"},
+		{Initiatives: map[string]Initiative{"seven": INITIATIVE_MANUAL}},
+		{Initiatives: map[string]Initiative{"7.0.0": "later"}},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Fatalf("Expecting %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestMandatoryUpdate(t *testing.T) {
+	rm := newTestReleaseManager(t, "7.1.0")
+	rm.SetConfig(&AppConfig{MinVersion: "6.0.0", Initiatives: map[string]Initiative{"7.1.0": INITIATIVE_MANUAL}})
+
+	r := expectUpdate(t, rm, testParams("6.5.0"), "7.1.0")
+	if r.Initiative != INITIATIVE_MANUAL || r.Mandatory {
+		t.Fatalf("Expecting an optional manual update, got %s (mandatory: %v)", r.Initiative, r.Mandatory)
+	}
+
+	r = expectUpdate(t, rm, testParams("5.0.0"), "7.1.0")
+	if r.Initiative != INITIATIVE_AUTO || !r.Mandatory {
+		t.Fatalf("Expecting a mandatory automatic update, got %s (mandatory: %v)", r.Initiative, r.Mandatory)
+	}
+}
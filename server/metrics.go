@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsPath = "/metrics"
+
+// Results of update checks, as reported by the update_checks_total metric.
+const (
+	CHECKRESULT_NO_UPDATE    = "no_update"
+	CHECKRESULT_FULL         = "full"
+	CHECKRESULT_PATCH        = "patch"
+	CHECKRESULT_ERROR        = "error"
+	CHECKRESULT_RATE_LIMITED = "rate_limited"
+)
+
+var (
+	metrics = prometheus.NewRegistry()
+
+	updateChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "autoupdate",
+		Name:      "update_checks_total",
+		Help:      "Update checks by app, OS, architecture and result.",
+	}, []string{"app", "os", "arch", "result"})
+	rateLimitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "autoupdate",
+		Name:      "rate_limit_rejections_total",
+		Help:      "Updates held back by rate limits, by app and release.",
+	}, []string{"app", "version"})
+	patchGenerationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "autoupdate",
+		Name:      "patch_generation_duration_seconds",
+		Help:      "Time taken to generate patches, including downloading the assets.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"type"})
+	patchGenerationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "autoupdate",
+		Name:      "patch_generation_failures_total",
+		Help:      "Patches that could not be generated.",
+	}, []string{"type"})
+	patchSizeBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "autoupdate",
+		Name:      "patch_size_bytes",
+		Help:      "Size of the generated patches.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"type"})
+	patchBytesServed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "autoupdate",
+		Name:      "patch_bytes_served_total",
+		Help:      "Bytes of patches served from /patches/.",
+	})
+	assetRefreshSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "autoupdate",
+		Name:      "asset_refresh_duration_seconds",
+		Help:      "Time taken to refresh the releases of a repo.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"repo"})
+	assetRefreshFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "autoupdate",
+		Name:      "asset_refresh_failures_total",
+		Help:      "Refreshes of the releases of a repo that failed.",
+	}, []string{"repo"})
+	catalogAssets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "autoupdate",
+		Name:      "catalog_assets",
+		Help:      "Update assets known for a repo.",
+	}, []string{"repo"})
+)
+
+func init() {
+	metrics.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		updateChecks,
+		rateLimitRejections,
+		patchGenerationSeconds,
+		patchGenerationFailures,
+		patchSizeBytes,
+		patchBytesServed,
+		assetRefreshSeconds,
+		assetRefreshFailures,
+		catalogAssets,
+	)
+}
+
+// MetricsHandler serves the metrics of the update server in the Prometheus
+// exposition format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metrics, promhttp.HandlerOpts{})
+}
+
+// countUpdateCheck records the result of an update check. Unknown OSes and
+// architectures sent by clients are counted as "other" to keep the number of
+// series bounded.
+func countUpdateCheck(app string, p *Params, result string) {
+	os, arch := "other", "other"
+	if p != nil {
+		switch p.OS {
+		case OS.Windows, OS.Linux, OS.Darwin, OS.Android:
+			os = p.OS
+		}
+		switch p.Arch {
+		case Arch.X64, Arch.X86, Arch.ARM:
+			arch = p.Arch
+		}
+	}
+	updateChecks.WithLabelValues(app, os, arch, result).Inc()
+}
+
+// observePatchGeneration records how long generating a patch took and its
+// size, or that it failed.
+func observePatchGeneration(patchType PatchType, start time.Time, p *Patch, err error) {
+	if err != nil {
+		patchGenerationFailures.WithLabelValues(string(patchType)).Inc()
+		return
+	}
+	patchGenerationSeconds.WithLabelValues(string(patchType)).Observe(time.Since(start).Seconds())
+	patchSizeBytes.WithLabelValues(string(patchType)).Observe(float64(fileSize(p.File)))
+}
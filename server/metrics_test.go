@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics returns the samples exposed at /metrics, keyed by name and
+// labels.
+func scrapeMetrics(t *testing.T, u *UpdateServer) map[string]float64 {
+	w := httptest.NewRecorder()
+	u.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expecting 200 OK from %s, got %d", metricsPath, w.Code)
+	}
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("Could not parse sample %q: %v", line, err)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	rm := NewReleaseManager("getlantern", "metrics")
+	rm.SetDefaultRateLimit(RateLimit{UpdatesPerSecond: 0.001})
+	pushTestAsset(t, rm, OS.Linux, Arch.X64, "7.1.0")
+
+	u := NewUpdateServer("http://127.0.0.1:9999/", "127.0.0.1:0", ".", 0)
+	u.apps["metrics"] = rm
+	u.handlers["metrics"] = u.handlerFor("metrics", rm)
+
+	check := func(body string, expected int) {
+		w := httptest.NewRecorder()
+		u.mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update/metrics", strings.NewReader(body)))
+		if w.Code != expected {
+			t.Fatalf("Expecting %d for %s, got %d", expected, body, w.Code)
+		}
+	}
+	check(`{"app_version": "7.0.0", "checksum": "?", "tags": {"os": "linux", "arch": "amd64"}}`, http.StatusOK)
+	check(`{"app_version": "7.0.0", "checksum": "?", "tags": {"os": "linux", "arch": "amd64"}}`, http.StatusNoContent)
+	check(`{"app_version": "7.1.0", "checksum": "?", "tags": {"os": "linux", "arch": "amd64"}}`, http.StatusNoContent)
+	check(`{"app_version": "7.0.0", "checksum": "?", "tags": {"os": "plan9", "arch": "mips"}}`, http.StatusExpectationFailed)
+	check(`{`, http.StatusBadRequest)
+
+	samples := scrapeMetrics(t, u)
+	for sample, expected := range map[string]float64{
+		`autoupdate_update_checks_total{app="metrics",arch="amd64",os="linux",result="full"}`:         1,
+		`autoupdate_update_checks_total{app="metrics",arch="amd64",os="linux",result="rate_limited"}`: 1,
+		`autoupdate_update_checks_total{app="metrics",arch="amd64",os="linux",result="no_update"}`:    1,
+		`autoupdate_update_checks_total{app="metrics",arch="other",os="other",result="error"}`:        2,
+		`autoupdate_rate_limit_rejections_total{app="metrics",version="7.1.0"}`:                       1,
+	} {
+		if samples[sample] != expected {
+			t.Errorf("Expecting %s to be %v, got %v", sample, expected, samples[sample])
+		}
+	}
+	if _, ok := samples["go_goroutines"]; !ok {
+		t.Error("Expecting runtime metrics to be exposed")
+	}
+
+	refreshed := newTestReleaseManagers(t)("getlantern", "metrics-refresh")
+	if err := refreshed.UpdateAssetsMap(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	samples = scrapeMetrics(t, u)
+	if samples[`autoupdate_asset_refresh_duration_seconds_count{repo="getlantern/metrics-refresh"}`] != 1 {
+		t.Error("Expecting the refresh to be timed")
+	}
+	if v, ok := samples[`autoupdate_catalog_assets{repo="getlantern/metrics-refresh"}`]; !ok || v != 0 {
+		t.Errorf("Expecting an empty catalog, got %v", v)
+	}
+	if _, ok := samples[`autoupdate_asset_refresh_failures_total{repo="getlantern/metrics-refresh"}`]; ok {
+		t.Error("Expecting no refresh failure")
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Mirror is an alternative location serving the same paths as the original
+// host of an asset or patch, like our own CDN or a domain-fronted host.
+type Mirror struct {
+	// BaseURL replaces the scheme and host of the original URL, its path is
+	// kept. For instance, with a base URL of https://cdn.example.com/gh
+	// https://github.com/getlantern/lantern/releases/download/7.0.0/update_linux_amd64
+	// becomes
+	// https://cdn.example.com/gh/getlantern/lantern/releases/download/7.0.0/update_linux_amd64
+	BaseURL string `json:"base_url"`
+	// Regions restricts the mirror to clients sending one of these values in
+	// their "region" tag. Regional mirrors are preferred over the original
+	// URL, mirrors without regions are only fallbacks.
+	Regions []string `json:"regions,omitempty"`
+}
+
+func (m *Mirror) validate() error {
+	u, err := url.Parse(m.BaseURL)
+	if err != nil {
+		return fmt.Errorf("bad mirror base URL %q: %v", m.BaseURL, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("mirror base URL %q must be absolute", m.BaseURL)
+	}
+	return nil
+}
+
+// url returns the location of original on this mirror.
+func (m *Mirror) url(original string) (string, error) {
+	u, err := url.Parse(original)
+	if err != nil {
+		return "", err
+	}
+	mirrored := strings.TrimSuffix(m.BaseURL, "/") + u.EscapedPath()
+	if u.RawQuery != "" {
+		mirrored = mirrored + "?" + u.RawQuery
+	}
+	return mirrored, nil
+}
+
+func (m *Mirror) servesRegion(region string) bool {
+	for _, r := range m.Regions {
+		if strings.EqualFold(r, region) {
+			return true
+		}
+	}
+	return false
+}
+
+// mirroredURLs returns the ordered list of URLs to download original from:
+// mirrors for the client's region first, then the original URL and then
+// mirrors for all regions.
+func mirroredURLs(original string, mirrors []Mirror, region string) []string {
+	var regional, global []string
+	for i := range mirrors {
+		m := &mirrors[i]
+		if len(m.Regions) > 0 && !m.servesRegion(region) {
+			continue
+		}
+		u, err := m.url(original)
+		if err != nil {
+			log.Errorf("Could not mirror %s on %s: %v", original, m.BaseURL, err)
+			continue
+		}
+		if len(m.Regions) > 0 {
+			regional = append(regional, u)
+		} else {
+			global = append(global, u)
+		}
+	}
+	urls := append(regional, original)
+	return append(urls, global...)
+}
+
+// addMirrors fills in the fallback URLs of a result. Presigned S3 URLs are
+// never mirrored, since their signature covers the host.
+func (c *AppConfig) addMirrors(r *Result, region string) {
+	if len(c.AssetMirrors) > 0 && r.URL != "" {
+		r.URLs = mirroredURLs(r.URL, c.AssetMirrors, region)
+	}
+	if len(c.PatchMirrors) > 0 && r.PatchURL != "" && !isPresigned(r.PatchURL) {
+		r.PatchURLs = mirroredURLs(r.PatchURL, c.PatchMirrors, region)
+	}
+}
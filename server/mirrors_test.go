@@ -0,0 +1,60 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMirroredURLs(t *testing.T) {
+	cfg := &AppConfig{
+		AssetMirrors: []Mirror{
+			{BaseURL: "https://cdn.example.com/gh/"},
+			{BaseURL: "https://fronted.example.com", Regions: []string{"IR", "cn"}},
+			{BaseURL: "https://ru.example.com", Regions: []string{"ru"}},
+		},
+		PatchMirrors: []Mirror{
+			{BaseURL: "https://patches.example.com"},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	original := "https://github.com/getlantern/lantern/releases/download/7.0.0/update_linux_amd64.bz2"
+
+	r := &Result{URL: original, PatchURL: "http://127.0.0.1:9999/patches/abcd"}
+	cfg.addMirrors(r, "cn")
+	expected := []string{
+		"https://fronted.example.com/getlantern/lantern/releases/download/7.0.0/update_linux_amd64.bz2",
+		original,
+		"https://cdn.example.com/gh/getlantern/lantern/releases/download/7.0.0/update_linux_amd64.bz2",
+	}
+	if !reflect.DeepEqual(r.URLs, expected) {
+		t.Fatalf("Expecting %v, got %v", expected, r.URLs)
+	}
+	if r.URL != original {
+		t.Fatal("The legacy URL must not change.")
+	}
+	if !reflect.DeepEqual(r.PatchURLs, []string{r.PatchURL, "https://patches.example.com/patches/abcd"}) {
+		t.Fatalf("Unexpected patch URLs %v", r.PatchURLs)
+	}
+
+	r = &Result{PatchURL: "https://patches.s3.amazonaws.com/abcd?X-Amz-Signature=0123"}
+	cfg.addMirrors(r, "")
+	if r.PatchURLs != nil {
+		t.Fatalf("Presigned patch URLs should not be mirrored, got %v", r.PatchURLs)
+	}
+
+	r = &Result{URL: original}
+	cfg.addMirrors(r, "")
+	if len(r.URLs) != 2 || r.URLs[0] != original {
+		t.Fatalf("Clients without region should get the original URL first, got %v", r.URLs)
+	}
+	if r.PatchURLs != nil {
+		t.Fatal("Expecting no patch URLs without a patch.")
+	}
+
+	if err := (&AppConfig{AssetMirrors: []Mirror{{BaseURL: "cdn.example.com"}}}).Validate(); err == nil {
+		t.Fatal("Relative mirror base URLs should be rejected.")
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// countingResponseWriter counts the bytes of the response body.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// patchesHandler serves generated patches. Patch names are content hashes, so
+// responses can be cached forever. Ranges are supported so clients can resume
+// interrupted downloads, and the SHA256 hash of the patch is sent along so
+// they can check what they got. Directory listings and metadata sidecars are
+// not exposed.
+func (u *UpdateServer) patchesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		if !isPatchName(name) {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			closeWithStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		file := path.Join(u.patchesDirectory, name)
+		fp, err := os.Open(file)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer fp.Close()
+
+		checksum, err := patchStore.Checksum(name, file)
+		if err != nil {
+			log.Errorf("Could not get checksum of patch %s: %v", name, err)
+			closeWithStatus(w, http.StatusInternalServerError)
+			return
+		}
+		sum, _ := hex.DecodeString(checksum)
+
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", `"`+checksum+`"`)
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+		w.Header().Set("X-Checksum-Sha256", checksum)
+
+		cw := &countingResponseWriter{ResponseWriter: w}
+		http.ServeContent(cw, r, name, time.Time{}, fp)
+		patchBytesServed.Add(float64(cw.n))
+
+		if err := patchStore.MarkServed(name, time.Now(), cw.n); err != nil {
+			log.Errorf("Could not update metadata of patch %s: %v", name, err)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPatchesHandler(t *testing.T) {
+	content := []byte("in a gadda da vida, honey")
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	name := patchName("old-checksum", "new-checksum", PATCHTYPE_BSDIFF)
+
+	if err := writeFile(patchStore.File(name), content); err != nil {
+		t.Fatal(err)
+	}
+	if err := patchStore.Put(&PatchInfo{Name: name, Type: PATCHTYPE_BSDIFF}); err != nil {
+		t.Fatal(err)
+	}
+
+	u := NewUpdateServer("", "127.0.0.1:0", patchesDirectory, 0)
+	srv := httptest.NewServer(u.mux)
+	defer srv.Close()
+
+	get := func(p string, headers map[string]string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+p, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res, body
+	}
+
+	res, body := get("/patches/"+name, nil)
+	if res.StatusCode != http.StatusOK || string(body) != string(content) {
+		t.Fatalf("Unexpected response %s: %q", res.Status, body)
+	}
+	if res.Header.Get("X-Checksum-Sha256") != checksum {
+		t.Fatalf("Unexpected checksum header %q", res.Header.Get("X-Checksum-Sha256"))
+	}
+	if res.Header.Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Fatalf("Unexpected Cache-Control %q", res.Header.Get("Cache-Control"))
+	}
+
+	etag := res.Header.Get("ETag")
+	res, body = get("/patches/"+name, map[string]string{"Range": "bytes=12-", "If-Range": etag})
+	if res.StatusCode != http.StatusPartialContent || string(body) != string(content[12:]) {
+		t.Fatalf("Unexpected range response %s: %q", res.Status, body)
+	}
+	res, _ = get("/patches/"+name, map[string]string{"Range": "bytes=12-", "If-Range": `"stale"`})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting the full patch when If-Range does not match, got %s", res.Status)
+	}
+
+	for _, p := range []string{"/patches/", "/patches/" + name + ".json", "/patches/../README.md"} {
+		if res, _ = get(p, nil); res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expecting 404 for %s, got %s", p, res.Status)
+		}
+	}
+
+	info, _ := patchStore.Get(name)
+	if expected := int64(2*len(content) + len(content) - 12); info.BytesServed != expected {
+		t.Fatalf("Expecting %d bytes served, got %d", expected, info.BytesServed)
+	}
+	if info.Checksum != checksum {
+		t.Fatal("Checksum should have been recorded.")
+	}
+}
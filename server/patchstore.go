@@ -0,0 +1,231 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	patchInfoExt = ".json"
+	// How often the last served time of a patch is written to disk. It's
+	// always up to date in memory.
+	patchServedFlushInterval = time.Minute
+)
+
+var patchStore *PatchStore
+
+func init() {
+	var err error
+	if patchStore, err = NewPatchStore(patchesDirectory); err != nil {
+		log.Fatalf("Could not load patch store: %q", err)
+	}
+}
+
+// PatchInfo holds the metadata that is stored in a sidecar file along with
+// each patch.
+type PatchInfo struct {
+	Name           string        `json:"name"`
+	App            string        `json:"app"` // owner/repo the patch was generated for.
+	Type           PatchType     `json:"type"`
+	Format         AssetFormat   `json:"format"` // Format of the patched assets.
+	SourceVersion  string        `json:"source_version"`
+	SourceChecksum string        `json:"source_checksum"`
+	SourceSize     int64         `json:"source_size"`
+	TargetVersion  string        `json:"target_version"`
+	TargetChecksum string        `json:"target_checksum"`
+	TargetSize     int64         `json:"target_size"`
+	Size           int64         `json:"size"`
+	Checksum       string        `json:"checksum"` // SHA256 hash of the patch.
+	Duration       time.Duration `json:"duration"` // Time it took to generate the patch, zero if unknown.
+	CreatedAt      time.Time     `json:"created_at"`
+	LastServedAt   time.Time     `json:"last_served_at"`
+	BytesServed    int64         `json:"bytes_served"`
+	Storage        string        `json:"storage,omitempty"` // ID of the storage the patch was published to.
+
+	flushedServedAt time.Time
+}
+
+// PatchStore keeps track of generated patches. Patches are content addressed:
+// their names are derived from the checksums of the two files and the patch
+// type.
+type PatchStore struct {
+	dir     string
+	patches map[string]*PatchInfo
+	mu      sync.RWMutex
+}
+
+// patchName returns the name of the patch that transforms a file with the
+// oldChecksum into a file with the newChecksum.
+func patchName(oldChecksum string, newChecksum string, t PatchType) string {
+	key := oldChecksum + "|" + newChecksum
+	if t != PATCHTYPE_BSDIFF {
+		key = key + "|" + string(t)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+// NewPatchStore creates a patch store for the given directory, loading any
+// existing sidecar files.
+func NewPatchStore(dir string) (*PatchStore, error) {
+	s := &PatchStore{
+		dir:     dir,
+		patches: make(map[string]*PatchInfo),
+	}
+
+	if err := os.MkdirAll(dir, os.ModeDir|0700); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), patchInfoExt) {
+			continue
+		}
+		b, err := os.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var info PatchInfo
+		if err := json.Unmarshal(b, &info); err != nil {
+			log.Errorf("Ignoring malformed patch sidecar %s: %v", entry.Name(), err)
+			continue
+		}
+		info.flushedServedAt = info.LastServedAt
+		s.patches[info.Name] = &info
+	}
+
+	return s, nil
+}
+
+// File returns the path to the patch with the given name.
+func (s *PatchStore) File(name string) string {
+	return path.Join(s.dir, name)
+}
+
+// Get returns a copy of the metadata of the patch with the given name.
+func (s *PatchStore) Get(name string) (*PatchInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info, ok := s.patches[name]
+	if !ok {
+		return nil, false
+	}
+	c := *info
+	return &c, true
+}
+
+// Find looks for a patch between two files with the given checksums. Patches
+// whose file is gone are not reported.
+func (s *PatchStore) Find(oldChecksum string, newChecksum string, t PatchType) (*PatchInfo, bool) {
+	info, ok := s.Get(patchName(oldChecksum, newChecksum, t))
+	if !ok || !fileExists(s.File(info.Name)) {
+		return nil, false
+	}
+	return info, true
+}
+
+// List returns the metadata of all known patches, most recently created
+// first.
+func (s *PatchStore) List() []*PatchInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*PatchInfo, 0, len(s.patches))
+	for _, info := range s.patches {
+		c := *info
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Put records the metadata of a patch and writes its sidecar file.
+func (s *PatchStore) Put(info *PatchInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := *info
+	c.flushedServedAt = c.LastServedAt
+	s.patches[c.Name] = &c
+	return s.writeInfo(&c)
+}
+
+// MarkServed records that n bytes of the patch with the given name have been
+// served.
+func (s *PatchStore) MarkServed(name string, t time.Time, n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, ok := s.patches[name]
+	if !ok {
+		return nil
+	}
+	info.LastServedAt = t
+	info.BytesServed += n
+	if t.Sub(info.flushedServedAt) < patchServedFlushInterval {
+		return nil
+	}
+	info.flushedServedAt = t
+	return s.writeInfo(info)
+}
+
+// Checksum returns the SHA256 hash of the patch with the given name,
+// computing it out of file and recording it if it's not known yet.
+func (s *PatchStore) Checksum(name string, file string) (string, error) {
+	if info, ok := s.Get(name); ok && info.Checksum != "" {
+		return info.Checksum, nil
+	}
+
+	checksum, err := checksumForFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info, ok := s.patches[name]; ok {
+		info.Checksum = checksum
+		if err := s.writeInfo(info); err != nil {
+			log.Errorf("Could not store checksum of patch %s: %v", name, err)
+		}
+	}
+	return checksum, nil
+}
+
+// writeInfo atomically replaces the sidecar file of a patch. It must be
+// called with s.mu held.
+func (s *PatchStore) writeInfo(info *PatchInfo) error {
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	sidecar := s.File(info.Name) + patchInfoExt
+	if err = os.WriteFile(sidecar+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(sidecar+".tmp", sidecar)
+}
+
+// isPatchName returns true if the given string is a valid patch name.
+func isPatchName(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
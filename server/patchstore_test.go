@@ -0,0 +1,83 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPatchStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "patchstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewPatchStore(dir)
+	if err != nil {
+		t.Fatalf("Could not create patch store: %v", err)
+	}
+
+	name := patchName("aaaa", "bbbb", PATCHTYPE_BSDIFF)
+	if name != fmt.Sprintf("%x", sha256.Sum256([]byte("aaaa|bbbb"))) {
+		t.Fatal("bsdiff patch names must not change, otherwise existing patches would be regenerated.")
+	}
+	if name == patchName("aaaa", "bbbb", PATCHTYPE_ARCHIVE) {
+		t.Fatal("Patch names must depend on the patch type.")
+	}
+
+	if _, ok := store.Find("aaaa", "bbbb", PATCHTYPE_BSDIFF); ok {
+		t.Fatal("Store should be empty.")
+	}
+
+	info := &PatchInfo{
+		Name:           name,
+		App:            "getlantern/lantern",
+		Type:           PATCHTYPE_BSDIFF,
+		Format:         ASSETFORMAT_RAW,
+		SourceVersion:  "5.0.0",
+		SourceChecksum: "aaaa",
+		TargetVersion:  "5.1.0",
+		TargetChecksum: "bbbb",
+		Size:           4,
+		Duration:       time.Second,
+		CreatedAt:      time.Now(),
+	}
+	if err = store.Put(info); err != nil {
+		t.Fatalf("Could not store patch info: %v", err)
+	}
+
+	if _, ok := store.Find("aaaa", "bbbb", PATCHTYPE_BSDIFF); ok {
+		t.Fatal("Patches without a file should not be found.")
+	}
+	if err = writeFile(store.File(name), []byte("diff")); err != nil {
+		t.Fatal(err)
+	}
+	found, ok := store.Find("aaaa", "bbbb", PATCHTYPE_BSDIFF)
+	if !ok {
+		t.Fatal("Expecting to find patch.")
+	}
+	if found.SourceVersion != "5.0.0" || found.TargetVersion != "5.1.0" {
+		t.Fatalf("Unexpected patch info: %+v", found)
+	}
+
+	servedAt := time.Now().Add(time.Hour)
+	if err = store.MarkServed(name, servedAt, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reloading from disk must preserve all metadata.
+	reloaded, err := NewPatchStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := reloaded.List()
+	if len(list) != 1 {
+		t.Fatalf("Expecting one patch, got %d", len(list))
+	}
+	if list[0].Duration != time.Second || !list[0].LastServedAt.Equal(servedAt) || list[0].BytesServed != 4 {
+		t.Fatalf("Unexpected patch info after reload: %+v", list[0])
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the updates offered to clients. Zero values mean no limit.
+type RateLimit struct {
+	// UpdatesPerSecond limits the number of updates offered.
+	UpdatesPerSecond float64 `json:"updates_per_second,omitempty"`
+	// BytesPerSecond limits the expected size of the downloads of the offered
+	// updates, either full assets or patches.
+	BytesPerSecond float64 `json:"bytes_per_second,omitempty"`
+}
+
+func (l *RateLimit) validate() error {
+	if l.UpdatesPerSecond < 0 || l.BytesPerSecond < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	return nil
+}
+
+// throttle is a token bucket holding one second worth of tokens that can go
+// into debt: requests that cost more than the bucket holds are let through
+// once the bucket is full and take their whole cost, so a large download
+// delays the following ones instead of never fitting in the bucket. Requests
+// are effectively queued until the debt is paid.
+type throttle struct {
+	rate float64 // Tokens per second.
+	// Time at which the bucket is full again.
+	full time.Time
+}
+
+// duration returns how long it takes to refill cost tokens.
+func (t *throttle) duration(cost float64) time.Duration {
+	return time.Duration(cost / t.rate * float64(time.Second))
+}
+
+// delay returns how long to wait until the bucket has enough tokens for a
+// request of the given cost, zero or less if it already has.
+func (t *throttle) delay(now time.Time, cost float64) time.Duration {
+	full := t.full
+	if full.Before(now) {
+		full = now
+	}
+	needed := t.duration(cost)
+	if needed > time.Second {
+		needed = time.Second
+	}
+	return full.Sub(now) + needed - time.Second
+}
+
+func (t *throttle) take(now time.Time, cost float64) {
+	if t.full.Before(now) {
+		t.full = now
+	}
+	t.full = t.full.Add(t.duration(cost))
+}
+
+// rateLimiter enforces the rate limits of an app and its releases.
+type rateLimiter struct {
+	throttles map[string]*throttle
+	mu        sync.Mutex
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{throttles: make(map[string]*throttle)}
+}
+
+// throttle returns the throttle with the given key, updating its rate if the
+// limits changed. It must be called with l.mu held.
+func (l *rateLimiter) throttle(now time.Time, key string, rate float64) *throttle {
+	t, ok := l.throttles[key]
+	if !ok {
+		t = &throttle{rate: rate}
+		l.throttles[key] = t
+	}
+	if t.rate != rate {
+		// Keep the same amount of tokens.
+		if t.full.After(now) {
+			t.full = now.Add(time.Duration(float64(t.full.Sub(now)) * t.rate / rate))
+		}
+		t.rate = rate
+	}
+	return t
+}
+
+// prune drops the throttles of the releases that keep returns false for.
+func (l *rateLimiter) prune(keep func(version string) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key := range l.throttles {
+		version := key[:strings.LastIndex(key, "/")]
+		if version != "" && !keep(version) {
+			delete(l.throttles, key)
+		}
+	}
+}
+
+// allow decides whether an update of the given size can be offered now, under
+// both the limits of the app and those of the release, and takes its cost if
+// so. If not, it returns how long the client should wait before trying again.
+func (l *rateLimiter) allow(now time.Time, appLimit RateLimit, version string, releaseLimit RateLimit, size int64) (bool, time.Duration) {
+	return l.reserve(now, appLimit, version, releaseLimit, size, true)
+}
+
+// check is like allow but leaves the limits untouched.
+func (l *rateLimiter) check(now time.Time, appLimit RateLimit, version string, releaseLimit RateLimit, size int64) (bool, time.Duration) {
+	return l.reserve(now, appLimit, version, releaseLimit, size, false)
+}
+
+func (l *rateLimiter) reserve(now time.Time, appLimit RateLimit, version string, releaseLimit RateLimit, size int64, take bool) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	type cost struct {
+		t *throttle
+		n float64
+	}
+	var costs []cost
+	for _, scope := range []struct {
+		key   string
+		limit RateLimit
+	}{
+		{"", appLimit},
+		{version, releaseLimit},
+	} {
+		if scope.limit.UpdatesPerSecond > 0 {
+			costs = append(costs, cost{l.throttle(now, scope.key+"/updates", scope.limit.UpdatesPerSecond), 1})
+		}
+		if scope.limit.BytesPerSecond > 0 {
+			costs = append(costs, cost{l.throttle(now, scope.key+"/bytes", scope.limit.BytesPerSecond), float64(size)})
+		}
+	}
+
+	var wait time.Duration
+	for _, c := range costs {
+		if d := c.t.delay(now, c.n); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	if take {
+		for _, c := range costs {
+			c.t.take(now, c.n)
+		}
+	}
+	return true, 0
+}
+
+// retryAfter formats a delay as the value of a Retry-After header.
+func retryAfter(d time.Duration) string {
+	return fmt.Sprintf("%d", retryAfterSeconds(d))
+}
+
+// retryAfterSeconds rounds a delay up to whole seconds, at least one.
+func retryAfterSeconds(d time.Duration) int64 {
+	return int64(math.Max(1, math.Ceil(d.Seconds())))
+}
+
+// SetDefaultRateLimit sets the rate limit of the app if its settings don't
+// set one. It's safe to call it while serving requests.
+func (g *ReleaseManager) SetDefaultRateLimit(limit RateLimit) {
+	g.defaultRateLimit.Store(&limit)
+}
+
+// RateLimit returns the rate limit in effect for the app, either the one of
+// its settings or the default one.
+func (g *ReleaseManager) RateLimit() RateLimit {
+	if limit := g.Config().RateLimit; limit != (RateLimit{}) {
+		return limit
+	}
+	if limit := g.defaultRateLimit.Load(); limit != nil {
+		return *limit
+	}
+	return RateLimit{}
+}
+
+// allowUpdate applies the rate limits of the app and of the release offered
+// in res.
+func (g *ReleaseManager) allowUpdate(res *Result) (bool, time.Duration) {
+	appLimit, releaseLimit := g.rateLimits(res)
+	return g.limiter.allow(g.clock(), appLimit, res.Version, releaseLimit, res.size)
+}
+
+// checkRateLimits is like allowUpdate but leaves the limits untouched.
+func (g *ReleaseManager) checkRateLimits(res *Result) (bool, time.Duration) {
+	appLimit, releaseLimit := g.rateLimits(res)
+	return g.limiter.check(g.clock(), appLimit, res.Version, releaseLimit, res.size)
+}
+
+// pruneRateLimits drops the throttles of the releases that are not rate
+// limited or known anymore. g.mu must be held.
+func (g *ReleaseManager) pruneRateLimits() {
+	limits := g.Config().ReleaseRateLimits
+	g.limiter.prune(func(version string) bool {
+		if _, ok := limits[version]; !ok {
+			return false
+		}
+		for _, arches := range g.updateAssetsMap {
+			for _, assets := range arches {
+				if _, ok := assets[version]; ok {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+func (g *ReleaseManager) rateLimits(res *Result) (appLimit RateLimit, releaseLimit RateLimit) {
+	return g.RateLimit(), g.Config().ReleaseRateLimits[res.Version]
+}
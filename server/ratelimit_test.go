@@ -0,0 +1,161 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/getlantern/autoupdate-server/instrument"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter()
+	appLimit := RateLimit{UpdatesPerSecond: 2}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow(now, appLimit, "7.0.0", RateLimit{}, 0); !ok {
+			t.Fatalf("Update %d should be allowed", i)
+		}
+	}
+	ok, wait := l.allow(now, appLimit, "7.0.0", RateLimit{}, 0)
+	if ok {
+		t.Fatal("Third update in the same second should be limited")
+	}
+	if wait != 500*time.Millisecond {
+		t.Fatalf("Expecting to wait for the next token, got %v", wait)
+	}
+	if ok, _ := l.allow(now.Add(500*time.Millisecond), appLimit, "7.0.0", RateLimit{}, 0); !ok {
+		t.Fatal("Update should be allowed once a token is available")
+	}
+
+	// Expected download sizes go into debt, so large downloads delay the
+	// following ones.
+	releaseLimit := RateLimit{BytesPerSecond: 1000}
+	if ok, _ := l.allow(now, RateLimit{}, "7.1.0", releaseLimit, 5000); !ok {
+		t.Fatal("First download should be allowed")
+	}
+	ok, wait = l.allow(now, RateLimit{}, "7.1.0", releaseLimit, 10)
+	if ok || wait != 4010*time.Millisecond {
+		t.Fatalf("Expecting to wait 4.01s, got %v, %v", ok, wait)
+	}
+	if ok, _ := l.allow(now, RateLimit{}, "7.2.0", releaseLimit, 10); !ok {
+		t.Fatal("Release limits should be independent")
+	}
+	if ok, _ := l.allow(now.Add(4010*time.Millisecond), RateLimit{}, "7.1.0", releaseLimit, 10); !ok {
+		t.Fatal("Download should be allowed once the debt is paid")
+	}
+
+	if retryAfter(0) != "1" || retryAfter(4*time.Second+time.Millisecond) != "5" {
+		t.Fatalf("Unexpected Retry-After values %s and %s", retryAfter(0), retryAfter(4*time.Second+time.Millisecond))
+	}
+}
+
+func TestPruneReleaseRateLimits(t *testing.T) {
+	rm := newTestReleaseManager(t, "7.0.0")
+	rm.SetConfig(&AppConfig{ReleaseRateLimits: map[string]RateLimit{
+		"7.0.0": {UpdatesPerSecond: 1},
+		"7.1.0": {UpdatesPerSecond: 1},
+	}})
+	for _, version := range []string{"7.0.0", "7.1.0"} {
+		if ok, _ := rm.allowUpdate(&Result{Version: version}); !ok {
+			t.Fatalf("First update to %s should be allowed", version)
+		}
+	}
+	rm.mu.Lock()
+	rm.pruneRateLimits()
+	rm.mu.Unlock()
+	if _, ok := rm.limiter.throttles["7.1.0/updates"]; ok {
+		t.Fatal("Throttles of unknown releases should be dropped")
+	}
+	if _, ok := rm.limiter.throttles["7.0.0/updates"]; !ok {
+		t.Fatal("Throttles of known releases should be kept")
+	}
+	rm.SetConfig(&AppConfig{})
+	if len(rm.limiter.throttles) != 0 {
+		t.Fatalf("Throttles of releases not rate limited anymore should be dropped, got %v", rm.limiter.throttles)
+	}
+}
+
+func TestRateLimitsPerApp(t *testing.T) {
+	lantern := NewReleaseManager("getlantern", "lantern")
+	beam := NewReleaseManager("getlantern", "beam")
+	for _, rm := range []*ReleaseManager{lantern, beam} {
+		rm.SetDefaultRateLimit(RateLimit{UpdatesPerSecond: 1})
+	}
+	res := &Result{Version: "7.0.0"}
+
+	if ok, _ := beam.allowUpdate(res); !ok {
+		t.Fatal("First beam update should be allowed")
+	}
+	if ok, _ := beam.allowUpdate(res); ok {
+		t.Fatal("Second beam update should be limited")
+	}
+	if ok, _ := lantern.allowUpdate(res); !ok {
+		t.Fatal("Beam updates should not use the lantern budget")
+	}
+
+	lantern.SetConfig(&AppConfig{RateLimit: RateLimit{UpdatesPerSecond: 100}})
+	for i := 0; i < 50; i++ {
+		if ok, _ := lantern.allowUpdate(res); !ok {
+			t.Fatalf("Lantern update %d should be allowed with the configured limit", i)
+		}
+	}
+}
+
+func TestRateLimitedRequest(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	rm := newTestReleaseManager(t, "7.1.0")
+	rm.SetDefaultRateLimit(RateLimit{UpdatesPerSecond: 0.001})
+	u := NewUpdateServer("http://127.0.0.1:9999/", "127.0.0.1:0", ".", 0)
+	handler := instrument.NewOTELMiddleware(tp)(u.handlerFor("lantern", rm))
+
+	check := func(expected int) sdktrace.ReadOnlySpan {
+		w := httptest.NewRecorder()
+		body := `{"app_version": "7.0.0", "checksum": "?", "tags": {"os": "linux", "arch": "amd64"}}`
+		r := httptest.NewRequest(http.MethodPost, "/update/lantern", strings.NewReader(body))
+		r.Header.Set("X-Lantern-User-Id", "1234")
+		r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		handler.ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Fatalf("Expecting %d, got %d", expected, w.Code)
+		}
+		spans := recorder.Ended()
+		for i := len(spans) - 1; i >= 0; i-- {
+			if spans[i].Name() == "autoupdate_download" {
+				return spans[i]
+			}
+		}
+		t.Fatal("Expecting the request to be traced")
+		return nil
+	}
+	check(http.StatusOK)
+	span := check(http.StatusNoContent)
+	if span.Status().Code == codes.Error {
+		t.Fatalf("Expecting rate limited updates not to fail the span, got %v", span.Status())
+	}
+	if !hasAttribute(span, attribute.Bool("rateLimited", true)) {
+		t.Fatalf("Expecting the span to be marked as rate limited, got %v", span.Attributes())
+	}
+	if !hasAttribute(span, attribute.Int64("userId", 1234)) {
+		t.Fatalf("Expecting the user ID of the client on the span, got %v", span.Attributes())
+	}
+}
+
+func hasAttribute(span sdktrace.ReadOnlySpan, kv attribute.KeyValue) bool {
+	for _, attr := range span.Attributes() {
+		if attr == kv {
+			return true
+		}
+	}
+	return false
+}
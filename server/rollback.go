@@ -0,0 +1,188 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/blang/semver"
+)
+
+// Rollback sends the clients running a broken release back to a previous
+// good one.
+type Rollback struct {
+	Version string `json:"version"` // The broken release.
+	Target  string `json:"target"`  // The release to go back to.
+}
+
+func (r *Rollback) validate() error {
+	v, err := semver.Parse(r.Version)
+	if err != nil {
+		return fmt.Errorf("bad rollback version %q: %v", r.Version, err)
+	}
+	target, err := semver.Parse(r.Target)
+	if err != nil {
+		return fmt.Errorf("bad rollback target %q: %v", r.Target, err)
+	}
+	if target.GTE(v) {
+		return fmt.Errorf("rollback target %s must be older than %s", r.Target, r.Version)
+	}
+	return nil
+}
+
+// isPaused returns true if the given release must not be offered, either
+// because it's paused or because it's being rolled back.
+func (c *AppConfig) isPaused(v semver.Version) bool {
+	for _, paused := range c.PausedVersions {
+		if pv, err := semver.Parse(paused); err == nil && pv.EQ(v) {
+			return true
+		}
+	}
+	for _, r := range c.Rollbacks {
+		if rv, err := semver.Parse(r.Version); err == nil && rv.EQ(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlocked returns true if the given asset must never be offered as an
+// update.
+func (c *AppConfig) isBlocked(a *Asset) bool {
+	for _, blocked := range c.BlockedVersions {
+		if bv, err := semver.Parse(blocked); err == nil && bv.EQ(a.v) {
+			return true
+		}
+	}
+	for _, checksum := range c.BlockedChecksums {
+		if strings.EqualFold(checksum, a.Checksum) {
+			return true
+		}
+	}
+	return false
+}
+
+// rollbackTarget returns the version clients running appVersion should go
+// back to, if any.
+func (c *AppConfig) rollbackTarget(appVersion semver.Version) (string, bool) {
+	for _, r := range c.Rollbacks {
+		if rv, err := semver.Parse(r.Version); err == nil && rv.EQ(appVersion) {
+			return r.Target, true
+		}
+	}
+	return "", false
+}
+
+// releaseOverrides are the pauses and rollbacks made at runtime, through the
+// admin API. They are applied on top of the configured settings so that
+// reloading the configuration doesn't undo them.
+type releaseOverrides struct {
+	// paused tells whether releases are paused, keyed by version.
+	paused map[string]bool
+	// rollbacks holds the rollback targets keyed by broken version, empty
+	// when a rollback was cancelled.
+	rollbacks map[string]string
+}
+
+// apply returns the settings in effect once the overrides are applied to
+// cfg.
+func (o *releaseOverrides) apply(cfg *AppConfig) *AppConfig {
+	if len(o.paused) == 0 && len(o.rollbacks) == 0 {
+		return cfg
+	}
+	c := *cfg
+
+	c.PausedVersions = nil
+	for _, version := range cfg.PausedVersions {
+		if _, overridden := o.paused[canonicalVersion(version)]; !overridden {
+			c.PausedVersions = append(c.PausedVersions, version)
+		}
+	}
+	for _, version := range sortedKeys(o.paused) {
+		if o.paused[version] {
+			c.PausedVersions = append(c.PausedVersions, version)
+		}
+	}
+
+	c.Rollbacks = nil
+	for _, r := range cfg.Rollbacks {
+		if _, overridden := o.rollbacks[canonicalVersion(r.Version)]; !overridden {
+			c.Rollbacks = append(c.Rollbacks, r)
+		}
+	}
+	for _, version := range sortedKeys(o.rollbacks) {
+		if target := o.rollbacks[version]; target != "" {
+			c.Rollbacks = append(c.Rollbacks, Rollback{Version: version, Target: target})
+		}
+	}
+	return &c
+}
+
+// canonicalVersion returns version as formatted by semver, or as is if it's
+// not a semantic version.
+func canonicalVersion(version string) string {
+	if v, err := semver.Parse(version); err == nil {
+		return v.String()
+	}
+	return version
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// override changes the runtime overrides and applies them to the configured
+// settings.
+func (g *ReleaseManager) override(change func(o *releaseOverrides)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	change(&g.overrides)
+	g.config.Store(g.overrides.apply(g.configured))
+	g.indexLatestAssets()
+}
+
+// PauseRelease stops or resumes offering the given release, whether it's
+// paused in the settings or not. It takes effect on the next request and
+// holds until the server restarts, across reloads of the settings.
+func (g *ReleaseManager) PauseRelease(version string, paused bool) error {
+	v, err := semver.Parse(version)
+	if err != nil {
+		return err
+	}
+	g.override(func(o *releaseOverrides) {
+		if o.paused == nil {
+			o.paused = make(map[string]bool)
+		}
+		o.paused[v.String()] = paused
+	})
+	return nil
+}
+
+// SetRollback sends the clients running version back to target, which must
+// be older. An empty target cancels the rollback, including one made in the
+// settings. It takes effect on the next request and holds until the server
+// restarts, across reloads of the settings.
+func (g *ReleaseManager) SetRollback(version string, target string) error {
+	v, err := semver.Parse(version)
+	if err != nil {
+		return err
+	}
+	rollback := Rollback{Version: v.String(), Target: target}
+	if target != "" {
+		if err := rollback.validate(); err != nil {
+			return err
+		}
+	}
+	g.override(func(o *releaseOverrides) {
+		if o.rollbacks == nil {
+			o.rollbacks = make(map[string]string)
+		}
+		o.rollbacks[v.String()] = target
+	})
+	return nil
+}
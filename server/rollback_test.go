@@ -0,0 +1,101 @@
+package server
+
+import "testing"
+
+func TestPauseAndRollback(t *testing.T) {
+	rm := newTestReleaseManager(t, "7.0.0", "7.1.0")
+	check := func(appVersion string, expected string) {
+		t.Helper()
+		expectUpdate(t, rm, testParams(appVersion), expected)
+	}
+
+	check("6.0.0", "7.1.0")
+
+	if err := rm.PauseRelease("7.1.0", true); err != nil {
+		t.Fatal(err)
+	}
+	check("6.0.0", "7.0.0")
+	check("7.1.0", "")
+
+	if err := rm.PauseRelease("7.1.0", false); err != nil {
+		t.Fatal(err)
+	}
+	check("6.0.0", "7.1.0")
+
+	if err := rm.SetRollback("7.1.0", "7.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	check("6.0.0", "7.0.0")
+	check("7.0.0", "")
+	check("7.1.0", "7.0.0")
+
+	if err := rm.SetRollback("7.1.0", ""); err != nil {
+		t.Fatal(err)
+	}
+	check("6.0.0", "7.1.0")
+	check("7.1.0", "")
+
+	// Runtime pauses and rollbacks survive reloads of the settings.
+	if err := rm.PauseRelease("7.1.0", true); err != nil {
+		t.Fatal(err)
+	}
+	rm.SetConfig(&AppConfig{MinVersion: "5.0.0"})
+	check("6.0.0", "7.0.0")
+	if err := rm.PauseRelease("7.1.0", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.SetRollback("7.1.0", "7.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	rm.SetConfig(&AppConfig{})
+	check("7.1.0", "7.0.0")
+
+	// And they override the settings: 7.1.0 was resumed and its rollback is
+	// cancelled.
+	if err := rm.SetRollback("7.1.0", ""); err != nil {
+		t.Fatal(err)
+	}
+	rm.SetConfig(&AppConfig{PausedVersions: []string{"7.1.0"}, Rollbacks: []Rollback{{Version: "7.1.0", Target: "7.0.0"}}})
+	check("6.0.0", "7.1.0")
+	check("7.1.0", "")
+	if err := rm.PauseRelease("7.1.0", true); err != nil {
+		t.Fatal(err)
+	}
+	check("6.0.0", "7.0.0")
+
+	if err := rm.SetRollback("7.0.0", "7.1.0"); err == nil {
+		t.Fatal("Rolling forward should be rejected")
+	}
+	if err := rm.PauseRelease("latest", true); err == nil {
+		t.Fatal("Pausing a bad version should be rejected")
+	}
+}
+
+func TestBlockedReleases(t *testing.T) {
+	rm := newTestReleaseManager(t)
+	rm.SetConfig(&AppConfig{BlockedVersions: []string{"7.1.0"}})
+	push := func(version string) *Asset {
+		return pushTestAsset(t, rm, OS.Linux, Arch.X64, version)
+	}
+	push("7.0.0")
+	blocked := push("7.1.0")
+
+	// The release before the blocked one is offered.
+	expectUpdate(t, rm, testParams("6.0.0"), "7.0.0")
+
+	push("7.2.0")
+	r := expectUpdate(t, rm, &Params{AppVersion: "7.1.0", OS: OS.Linux, Arch: Arch.X64, Checksum: blocked.Checksum}, "7.2.0")
+	if r.PatchURL == "" {
+		t.Fatalf("Clients running a blocked release should get a patch away from it, got %+v", r)
+	}
+
+	// Blocking by checksum takes effect when the settings change.
+	rm.SetConfig(&AppConfig{BlockedChecksums: []string{blocked.Checksum}})
+	if latest, err := rm.getProductUpdate(CHANNEL_STABLE, OS.Linux, Arch.X64); err != nil || latest.v.String() != "7.2.0" {
+		t.Fatalf("Expecting 7.2.0 to be the latest release, got %v, %v", latest, err)
+	}
+	rm.SetConfig(&AppConfig{BlockedChecksums: []string{rm.latestAssetsMap[OS.Linux][Arch.X64].Checksum}})
+	if latest, err := rm.getProductUpdate(CHANNEL_STABLE, OS.Linux, Arch.X64); err != nil || latest.v.String() != "7.1.0" {
+		t.Fatalf("Expecting 7.1.0 to be the latest release once 7.2.0 is blocked, got %v, %v", latest, err)
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/blang/semver"
+)
+
+const (
+	// Rollout percentages have a resolution of 0.01%.
+	rolloutBuckets = 10000
+	// Header carrying the user ID of Lantern clients.
+	userIDHeader = "X-Lantern-User-Id"
+)
+
+// Rollout limits a release to a percentage of clients.
+type Rollout struct {
+	Version    string  `json:"version"`
+	Percentage float64 `json:"percentage"` // From 0 to 100.
+	// Cohorts restricts the release to the clients of these cohorts, the
+	// percentage applies within them.
+	Cohorts []string `json:"cohorts,omitempty"`
+}
+
+func (r *Rollout) validate() error {
+	if _, err := semver.Parse(r.Version); err != nil {
+		return fmt.Errorf("bad rollout version %q: %v", r.Version, err)
+	}
+	if r.Percentage < 0 || r.Percentage > 100 {
+		return fmt.Errorf("rollout percentage of %s must be between 0 and 100, got %v", r.Version, r.Percentage)
+	}
+	return nil
+}
+
+// rollout returns the rollout of the given release, if any.
+func (c *AppConfig) rollout(v semver.Version) *Rollout {
+	for i := range c.Rollouts {
+		if rv, err := semver.Parse(c.Rollouts[i].Version); err == nil && rv.EQ(v) {
+			return &c.Rollouts[i]
+		}
+	}
+	return nil
+}
+
+// rolloutPercentage returns the percentage of clients the given release is
+// offered to. Releases without a rollout are offered to everyone.
+func (c *AppConfig) rolloutPercentage(v semver.Version) float64 {
+	if r := c.rollout(v); r != nil {
+		return r.Percentage
+	}
+	return 100
+}
+
+// inRolloutCohorts returns true if the given release is rolled out to the
+// client's cohort.
+func (c *AppConfig) inRolloutCohorts(v semver.Version, cohort string) bool {
+	r := c.rollout(v)
+	if r == nil || len(r.Cohorts) == 0 {
+		return true
+	}
+	for _, name := range r.Cohorts {
+		if name == cohort {
+			return true
+		}
+	}
+	return false
+}
+
+// inRollout decides whether the given release should be offered to the
+// client. The decision only depends on the client ID and the version, so
+// clients don't flip between updating and not updating, and raising the
+// percentage only adds clients.
+func (c *AppConfig) inRollout(v semver.Version, clientID string) bool {
+	percentage := c.rolloutPercentage(v)
+	if percentage >= 100 {
+		return true
+	}
+	if clientID == "" {
+		// We can't tell this client apart from others.
+		return false
+	}
+	return rolloutBucket(clientID, v) < uint64(percentage*rolloutBuckets/100)
+}
+
+// rolloutBucket deterministically maps a client and a version to a bucket.
+// Hashing the version too makes sure the same clients are not always the
+// first ones to get every release.
+func rolloutBucket(clientID string, v semver.Version) uint64 {
+	h := sha256.Sum256([]byte(v.String() + "|" + clientID))
+	return binary.BigEndian.Uint64(h[:8]) % rolloutBuckets
+}
+
+// clientID returns the identifier of the client used for rollouts: the value
+// of the configured tag if any, or the user ID otherwise.
+func (c *AppConfig) clientID(p *Params) string {
+	if c.RolloutTag != "" {
+		return p.Tags[c.RolloutTag]
+	}
+	return p.UserID
+}
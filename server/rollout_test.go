@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func TestInRollout(t *testing.T) {
+	v := semver.MustParse("7.1.0")
+	ten := &AppConfig{Rollouts: []Rollout{{Version: "7.1.0", Percentage: 10}}}
+	fifty := &AppConfig{Rollouts: []Rollout{{Version: "7.1.0", Percentage: 50}}}
+
+	in := 0
+	for i := 0; i < 10000; i++ {
+		clientID := fmt.Sprintf("user-%d", i)
+		if ten.inRollout(v, clientID) {
+			in++
+			if !fifty.inRollout(v, clientID) {
+				t.Fatalf("Widening the rollout must not leave %s out.", clientID)
+			}
+		}
+		if ten.inRollout(v, clientID) != ten.inRollout(v, clientID) {
+			t.Fatal("Rollout decisions must be stable.")
+		}
+	}
+	if in < 900 || in > 1100 {
+		t.Fatalf("Expecting about 10%% of clients in the rollout, got %d out of 10000", in)
+	}
+
+	if ten.inRollout(v, "") {
+		t.Fatal("Clients without ID should not be part of partial rollouts.")
+	}
+	if !ten.inRollout(semver.MustParse("7.0.0"), "") {
+		t.Fatal("Releases without rollout should be offered to everyone.")
+	}
+}
+
+func TestRolloutFallsBackToPreviousRelease(t *testing.T) {
+	rm := newTestReleaseManager(t, "7.0.0", "7.1.0")
+	check := func(percentage float64, expected string) {
+		t.Helper()
+		rm.SetConfig(&AppConfig{
+			Rollouts:   []Rollout{{Version: "7.1.0", Percentage: percentage}},
+			RolloutTag: "device_id",
+		})
+		params := testParams("6.0.0")
+		params.Tags = map[string]string{"device_id": "abc"}
+		expectUpdate(t, rm, params, expected)
+	}
+	check(0, "7.0.0")
+	check(100, "7.1.0")
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/blang/semver"
+)
+
+// RuleAction is what happens to the clients matched by a rule.
+type RuleAction string
+
+const (
+	// Offer exactly the rule version, typically the last one that runs on
+	// an old OS.
+	RULEACTION_PIN RuleAction = "pin"
+	// Don't offer any update.
+	RULEACTION_BLOCK RuleAction = "block"
+	// Offer the newest release up to the rule version.
+	RULEACTION_CAP RuleAction = "cap"
+	// Offer the usual update with the rule initiative.
+	RULEACTION_INITIATIVE RuleAction = "initiative"
+)
+
+// Rule overrides the update offered to the clients it matches. Empty
+// conditions match every client.
+type Rule struct {
+	// Name describes the rule in logs.
+	Name string `json:"name,omitempty"`
+	OS   string `json:"os,omitempty"`
+	Arch string `json:"arch,omitempty"`
+	// OSVersion is a semantic version range like "<6.0.0" or
+	// ">=10.0.0 <11.0.0". Clients with an OS version that is not semantic
+	// don't match.
+	OSVersion string `json:"os_version,omitempty"`
+	// AppVersion is a range of versions of the app updating itself.
+	AppVersion string `json:"app_version,omitempty"`
+	// Tags must all be sent by the client with the same values.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	Action RuleAction `json:"action"`
+	// Version is the version to pin to or to cap at.
+	Version string `json:"version,omitempty"`
+	// Initiative replaces the initiative of the offered update, if set.
+	Initiative Initiative `json:"initiative,omitempty"`
+}
+
+// defaultLanternRules are the rules of the lantern app if it has none
+// configured.
+func (c *AppConfig) defaultLanternRules() []Rule {
+	windowsXP, osxYosemite := c.LastWindowsXPVersion, c.LastOSXYosemiteVersion
+	if windowsXP == "" {
+		windowsXP = lastLanternVersionForWindowsXP
+	}
+	if osxYosemite == "" {
+		osxYosemite = lastLanternVersionForOSXYosemite
+	}
+	return []Rule{
+		{Name: "osx-before-3.6.0", OS: OS.Darwin, AppVersion: "<3.6.0", Action: RULEACTION_BLOCK},
+		// Windows XP/2003 or below
+		{Name: "windows-xp", OS: OS.Windows, OSVersion: "<6.0.0", Action: RULEACTION_PIN, Version: windowsXP},
+		// OSX 10.10 Yosemite or below
+		{Name: "osx-yosemite", OS: OS.Darwin, OSVersion: "<15.0.0", Action: RULEACTION_PIN, Version: osxYosemite},
+	}
+}
+
+func (r *Rule) validate() error {
+	for _, versionRange := range []string{r.OSVersion, r.AppVersion} {
+		if versionRange == "" {
+			continue
+		}
+		if _, err := semver.ParseRange(versionRange); err != nil {
+			return fmt.Errorf("bad version range %q in rule %s: %v", versionRange, r.Name, err)
+		}
+	}
+	switch r.Action {
+	case RULEACTION_PIN, RULEACTION_CAP:
+		if _, err := semver.Parse(r.Version); err != nil {
+			return fmt.Errorf("bad version %q in rule %s: %v", r.Version, r.Name, err)
+		}
+	case RULEACTION_BLOCK:
+	case RULEACTION_INITIATIVE:
+		if r.Initiative == "" {
+			return fmt.Errorf("rule %s must set an initiative", r.Name)
+		}
+	default:
+		return fmt.Errorf("unknown action %q in rule %s", r.Action, r.Name)
+	}
+	if r.Initiative != "" {
+		if err := r.Initiative.validate(); err != nil {
+			return fmt.Errorf("bad rule %s: %v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+// matches returns true if the rule applies to the client. Rules pinning to or
+// capping at a bad version never apply.
+func (r *Rule) matches(p *Params, appVersion semver.Version) bool {
+	if r.Action == RULEACTION_PIN || r.Action == RULEACTION_CAP {
+		if _, err := semver.Parse(r.Version); err != nil {
+			log.Errorf("Ignoring rule %s with bad version %q: %v", r.Name, r.Version, err)
+			return false
+		}
+	}
+	if r.OS != "" && r.OS != p.OS {
+		return false
+	}
+	if r.Arch != "" && r.Arch != p.Arch {
+		return false
+	}
+	if r.OSVersion != "" {
+		osVersion, err := semver.Parse(p.OSVersion)
+		if err != nil || !inVersionRange(r.OSVersion, osVersion) {
+			return false
+		}
+	}
+	if r.AppVersion != "" && !inVersionRange(r.AppVersion, appVersion) {
+		return false
+	}
+	for k, v := range r.Tags {
+		if p.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func inVersionRange(versionRange string, v semver.Version) bool {
+	inRange, err := semver.ParseRange(versionRange)
+	if err != nil {
+		log.Errorf("Ignoring bad version range %q: %v", versionRange, err)
+		return false
+	}
+	return inRange(v)
+}
+
+// rules returns the rules of the app, in evaluation order.
+func (c *AppConfig) rules(isLantern bool) []Rule {
+	if c.Rules == nil && isLantern {
+		return c.defaultLanternRules()
+	}
+	return c.Rules
+}
+
+// matchRule returns the first rule that applies to the client, if any.
+func (c *AppConfig) matchRule(p *Params, appVersion semver.Version, isLantern bool) *Rule {
+	rules := c.rules(isLantern)
+	for i := range rules {
+		if rules[i].matches(p, appVersion) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
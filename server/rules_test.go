@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	rm := newTestReleaseManager(t)
+	for _, os := range []string{OS.Windows, OS.Darwin} {
+		for _, version := range []string{"5.4.1", "6.0.0", "7.0.0"} {
+			pushTestAsset(t, rm, os, Arch.X64, version)
+		}
+	}
+
+	custom := []Rule{
+		{Name: "block-testers", Tags: map[string]string{"group": "testers"}, Action: RULEACTION_BLOCK},
+		{Name: "cap-windows-7", OS: OS.Windows, OSVersion: ">=6.1.0 <6.2.0", Action: RULEACTION_CAP, Version: "6.5.0"},
+		{Name: "manual-old-apps", AppVersion: "<5.0.0", Action: RULEACTION_INITIATIVE, Initiative: INITIATIVE_MANUAL},
+	}
+
+	for _, test := range []struct {
+		name       string
+		rules      []Rule
+		isLantern  bool
+		os         string
+		osVersion  string
+		appVersion string
+		tags       map[string]string
+		version    string // Expected version, empty if no update.
+		initiative Initiative
+	}{
+		{"latest", nil, true, OS.Windows, "10.0.0", "5.0.0", nil, "7.0.0", INITIATIVE_AUTO},
+		{"windows xp pinned", nil, true, OS.Windows, "5.1.0", "5.0.0", nil, "5.4.1", INITIATIVE_AUTO},
+		{"windows xp up to date", nil, true, OS.Windows, "5.1.0", "5.4.1", nil, "", ""},
+		{"yosemite pinned", nil, true, OS.Darwin, "14.4.1", "5.0.0", nil, "5.4.1", INITIATIVE_AUTO},
+		{"old osx app blocked", nil, true, OS.Darwin, "19.0.0", "3.5.0", nil, "", ""},
+		{"osx app", nil, true, OS.Darwin, "19.0.0", "3.6.0", nil, "7.0.0", INITIATIVE_AUTO},
+		{"bad os version", nil, true, OS.Windows, "XP", "5.0.0", nil, "7.0.0", INITIATIVE_AUTO},
+		{"no default rules for other apps", nil, false, OS.Windows, "5.1.0", "5.0.0", nil, "7.0.0", INITIATIVE_AUTO},
+		{"no rules", []Rule{}, true, OS.Windows, "5.1.0", "5.0.0", nil, "7.0.0", INITIATIVE_AUTO},
+		{"blocked by tag", custom, true, OS.Windows, "10.0.0", "5.0.0", map[string]string{"group": "testers"}, "", ""},
+		{"other tag", custom, true, OS.Windows, "10.0.0", "5.0.0", map[string]string{"group": "users"}, "7.0.0", INITIATIVE_AUTO},
+		{"capped", custom, true, OS.Windows, "6.1.7601", "5.0.0", nil, "6.0.0", INITIATIVE_AUTO},
+		{"cap on other os", custom, true, OS.Darwin, "6.1.0", "5.0.0", nil, "7.0.0", INITIATIVE_AUTO},
+		{"forced initiative", custom, true, OS.Darwin, "19.0.0", "4.0.0", nil, "7.0.0", INITIATIVE_MANUAL},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rm.SetConfig(&AppConfig{Rules: test.rules})
+			params := &Params{
+				AppVersion: test.appVersion,
+				OS:         test.os,
+				OSVersion:  test.osVersion,
+				Arch:       Arch.X64,
+				Checksum:   "?",
+				Tags:       test.tags,
+			}
+			r, err := rm.CheckForUpdate(context.Background(), params, test.isLantern)
+			if test.version == "" {
+				if err != ErrNoUpdateAvailable {
+					t.Fatalf("Expecting no update, got %v, %v", r, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckForUpdate: %v", err)
+			}
+			if r.Version != test.version || r.Initiative != test.initiative {
+				t.Fatalf("Expecting %s (%s), got %s (%s)", test.version, test.initiative, r.Version, r.Initiative)
+			}
+		})
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	for _, rule := range []Rule{
+		{Name: "bad range", OSVersion: "<six", Action: RULEACTION_BLOCK},
+		{Name: "bad pin", Action: RULEACTION_PIN, Version: "latest"},
+		{Name: "missing cap", Action: RULEACTION_CAP},
+		{Name: "missing initiative", Action: RULEACTION_INITIATIVE},
+		{Name: "bad initiative", Action: RULEACTION_BLOCK, Initiative: "now"},
+		{Name: "unknown action", Action: "upgrade"},
+	} {
+		cfg := &AppConfig{Rules: []Rule{rule}}
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("Expecting rule %q to be rejected", rule.Name)
+		}
+	}
+	if err := (&AppConfig{LastWindowsXPVersion: "5.4"}).Validate(); err == nil {
+		t.Fatal("Expecting a bad last version for Windows XP to be rejected")
+	}
+	cfg := &AppConfig{Rules: (&AppConfig{}).defaultLanternRules()}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Default rules should be valid: %v", err)
+	}
+}
+
+func TestRulesWithBadVersions(t *testing.T) {
+	rm := newTestReleaseManager(t, "6.0.0", "7.0.0")
+	// Settings set without validation, like by embedders.
+	rm.SetConfig(&AppConfig{Rules: []Rule{
+		{Name: "bad-cap", Action: RULEACTION_CAP, Version: "six"},
+		{Name: "cap", Action: RULEACTION_CAP, Version: "6.0.0"},
+	}})
+	expectUpdate(t, rm, testParams("5.0.0"), "6.0.0")
+}
+
+func TestLastVersionsForOldOSes(t *testing.T) {
+	rm := newTestReleaseManager(t)
+	for _, version := range []string{"5.3.4", "5.4.1", "7.0.0"} {
+		pushTestAsset(t, rm, OS.Windows, Arch.X64, version)
+	}
+	params := &Params{AppVersion: "5.0.0", OS: OS.Windows, Arch: Arch.X64, OSVersion: "5.1.0", Checksum: "?"}
+	for _, lastVersion := range []string{"", "5.3.4"} {
+		rm.SetConfig(&AppConfig{LastWindowsXPVersion: lastVersion})
+		expected := lastVersion
+		if expected == "" {
+			expected = lastLanternVersionForWindowsXP
+		}
+		r, err := rm.CheckForUpdate(context.Background(), params, true)
+		if err != nil || r.Version != expected {
+			t.Fatalf("Expecting Windows XP to be pinned to %s, got %v, %v", expected, r, err)
+		}
+	}
+}
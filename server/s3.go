@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3DateFormat      = "20060102T150405Z"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+	defaultPresignExpiry = 24 * time.Hour
+	// defaultUploadTimeout bounds the uploads of patches when no client is
+	// set.
+	defaultUploadTimeout = 5 * time.Minute
+)
+
+var s3Client = &http.Client{Timeout: defaultUploadTimeout}
+
+// S3PatchStorage uploads patches to an S3-compatible bucket. Clients download
+// them either from a CDN in front of the bucket or through presigned URLs.
+type S3PatchStorage struct {
+	// Endpoint is the base URL of the S3 API, like https://s3.amazonaws.com.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to patch names to build object keys.
+	Prefix string
+	// PathStyle addresses the bucket as part of the path instead of as a
+	// subdomain of the endpoint, which most S3 stand-ins require.
+	PathStyle       bool
+	AccessKeyID     string
+	SecretAccessKey string
+	// PublicURL is the base URL of a CDN serving the bucket. If empty,
+	// clients get presigned URLs.
+	PublicURL string
+	// PresignExpiry is how long presigned URLs are valid, 24 hours by default.
+	PresignExpiry time.Duration
+	// Client is the HTTP client used for uploads, one that times out after
+	// 5 minutes by default.
+	Client *http.Client
+
+	now func() time.Time
+}
+
+// ID implements PatchStorage.
+func (s *S3PatchStorage) ID() string {
+	return fmt.Sprintf("s3:%s/%s/%s", s.Endpoint, s.Bucket, s.Prefix)
+}
+
+// Put implements PatchStorage.
+func (s *S3PatchStorage) Put(ctx context.Context, name string, file string) error {
+	fp, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, fp); err != nil {
+		return err
+	}
+	payloadHash := hex.EncodeToString(h.Sum(nil))
+	if _, err = fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	stat, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+
+	u, err := s.objectURL(name)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), fp)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = stat.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	s.sign(req, payloadHash)
+
+	client := s.Client
+	if client == nil {
+		client = s3Client
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not upload patch %s: %v", name, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("Could not upload patch %s, expecting 200 OK, got: %s %s", name, res.Status, body)
+	}
+	return nil
+}
+
+// URL implements PatchStorage.
+func (s *S3PatchStorage) URL(name string) (string, error) {
+	if s.PublicURL != "" {
+		return strings.TrimSuffix(s.PublicURL, "/") + "/" + s.key(name), nil
+	}
+	u, err := s.objectURL(name)
+	if err != nil {
+		return "", err
+	}
+	return s.presign(u), nil
+}
+
+func (s *S3PatchStorage) key(name string) string {
+	return s.Prefix + name
+}
+
+func (s *S3PatchStorage) objectURL(name string) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + "/" + s.key(name)
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + s.key(name)
+	}
+	return u, nil
+}
+
+func (s *S3PatchStorage) clock() time.Time {
+	if s.now != nil {
+		return s.now().UTC()
+	}
+	return time.Now().UTC()
+}
+
+func (s *S3PatchStorage) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+// sign adds an AWS signature version 4 Authorization header to req, covering
+// its host and every header already set.
+func (s *S3PatchStorage) sign(req *http.Request, payloadHash string) {
+	t := s.clock()
+
+	req.Header.Set("X-Amz-Date", t.Format(s3DateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	canonicalHeaders, signedHeaders := s3CanonicalHeaders(headers)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EncodePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	signature := s.signature(t, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.AccessKeyID, s.scope(t), signedHeaders, signature))
+}
+
+// presign returns a GET URL for u that is valid for PresignExpiry.
+func (s *S3PatchStorage) presign(u *url.URL) string {
+	t := s.clock()
+	expiry := s.PresignExpiry
+	if expiry == 0 {
+		expiry = defaultPresignExpiry
+	}
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", s3Algorithm)
+	query.Set("X-Amz-Credential", s.AccessKeyID+"/"+s.scope(t))
+	query.Set("X-Amz-Date", t.Format(s3DateFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalHeaders, signedHeaders := s3CanonicalHeaders(map[string]string{"host": u.Host})
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		s3EncodePath(u.Path),
+		s3CanonicalQuery(query),
+		canonicalHeaders,
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	query.Set("X-Amz-Signature", s.signature(t, canonicalRequest))
+	presigned := *u
+	presigned.RawPath = s3EncodePath(u.Path)
+	presigned.RawQuery = s3CanonicalQuery(query)
+	return presigned.String()
+}
+
+// isPresigned tells whether rawURL is a presigned S3 URL.
+func isPresigned(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Query().Has("X-Amz-Signature")
+}
+
+func (s *S3PatchStorage) signature(t time.Time, canonicalRequest string) string {
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		t.Format(s3DateFormat),
+		s.scope(t),
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+s.SecretAccessKey), t.Format("20060102"))
+	key = s3HMAC(key, s.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3CanonicalHeaders(headers map[string]string) (canonical string, signed string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	return b.String(), strings.Join(names, ";")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, s3Encode(k, true)+"="+s3Encode(query.Get(k), true))
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3EncodePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return s3Encode(p, false)
+}
+
+// s3Encode URI-encodes s the way AWS expects it: every byte except unreserved
+// characters is percent-encoded, slashes only if encodeSlash is set.
+func s3Encode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+const windowTimeFormat = "15:04"
+
+// UpdateWindow is a daily time range during which updates are offered.
+type UpdateWindow struct {
+	// Start and End are times of the day like "02:00" and "06:30". Windows
+	// ending before they start span midnight.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Timezone is the IANA name of the timezone of Start and End, like
+	// "Asia/Tehran". Defaults to UTC.
+	Timezone string `json:"timezone,omitempty"`
+	// Regions restricts the window to clients sending one of these values in
+	// their "region" tag.
+	Regions []string `json:"regions,omitempty"`
+}
+
+func (w *UpdateWindow) validate() error {
+	for _, t := range []string{w.Start, w.End} {
+		if _, err := time.Parse(windowTimeFormat, t); err != nil {
+			return fmt.Errorf("bad update window time %q: %v", t, err)
+		}
+	}
+	if _, err := time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("bad update window timezone %q: %v", w.Timezone, err)
+	}
+	return nil
+}
+
+func (w *UpdateWindow) servesRegion(region string) bool {
+	for _, r := range w.Regions {
+		if strings.EqualFold(r, region) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains returns true if t falls within the window.
+func (w *UpdateWindow) contains(t time.Time) bool {
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		log.Errorf("Ignoring update window with bad timezone %q: %v", w.Timezone, err)
+		return false
+	}
+	start, err1 := time.Parse(windowTimeFormat, w.Start)
+	end, err2 := time.Parse(windowTimeFormat, w.End)
+	if err1 != nil || err2 != nil {
+		log.Errorf("Ignoring update window with bad times %q-%q", w.Start, w.End)
+		return false
+	}
+	t = t.In(loc)
+	minute := t.Hour()*60 + t.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+	if from <= to {
+		return from <= minute && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// inUpdateWindow returns true if updates can be offered at t to clients from
+// the given region. The windows of the region apply if there are any,
+// otherwise the windows without regions. Updates are always offered if no
+// window applies.
+func (c *AppConfig) inUpdateWindow(region string, t time.Time) bool {
+	var regional, global []*UpdateWindow
+	for i := range c.UpdateWindows {
+		w := &c.UpdateWindows[i]
+		if len(w.Regions) == 0 {
+			global = append(global, w)
+		} else if w.servesRegion(region) {
+			regional = append(regional, w)
+		}
+	}
+	windows := regional
+	if len(windows) == 0 {
+		windows = global
+	}
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// isActive returns true if the given release is available at t.
+func (c *AppConfig) isActive(v semver.Version, t time.Time) bool {
+	activation, ok := c.Activations[v.String()]
+	return !ok || !t.Before(activation)
+}
+
+// clock returns the current time.
+func (g *ReleaseManager) clock() time.Time {
+	if g.now != nil {
+		return g.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateWindows(t *testing.T) {
+	cfg := &AppConfig{UpdateWindows: []UpdateWindow{
+		{Start: "02:00", End: "06:00"},
+		{Start: "22:00", End: "03:00", Timezone: "Asia/Tehran", Regions: []string{"ir"}},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		region   string
+		at       string
+		expected bool
+	}{
+		{"", "2024-05-01T01:59:00Z", false},
+		{"", "2024-05-01T02:00:00Z", true},
+		{"cn", "2024-05-01T05:59:00Z", true},
+		{"", "2024-05-01T06:00:00Z", false},
+		// 22:30 in Tehran is 19:00 UTC.
+		{"IR", "2024-05-01T19:00:00Z", true},
+		{"ir", "2024-05-01T23:00:00Z", true},
+		{"ir", "2024-05-01T03:00:00Z", false},
+	} {
+		at, _ := time.Parse(time.RFC3339, test.at)
+		if actual := cfg.inUpdateWindow(test.region, at); actual != test.expected {
+			t.Fatalf("Expecting %v for region %q at %s, got %v", test.expected, test.region, test.at, actual)
+		}
+	}
+
+	if !(&AppConfig{}).inUpdateWindow("ir", time.Now()) {
+		t.Fatal("Updates should always be offered without windows")
+	}
+	for _, bad := range []UpdateWindow{
+		{Start: "2am", End: "06:00"},
+		{Start: "02:00", End: "06:00", Timezone: "Mars/Olympus"},
+	} {
+		if err := (&AppConfig{UpdateWindows: []UpdateWindow{bad}}).Validate(); err == nil {
+			t.Fatalf("Expecting %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestReleaseActivation(t *testing.T) {
+	rm := newTestReleaseManager(t, "7.0.0", "7.1.0")
+
+	activation := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	rm.SetConfig(&AppConfig{
+		Activations:   map[string]time.Time{"7.1.0": activation},
+		UpdateWindows: []UpdateWindow{{Start: "00:00", End: "18:00"}},
+	})
+
+	check := func(now time.Time, expected string) {
+		t.Helper()
+		rm.now = func() time.Time { return now }
+		expectUpdate(t, rm, testParams("6.0.0"), expected)
+	}
+
+	check(activation.Add(-time.Minute), "7.0.0")
+	check(activation, "7.1.0")
+	check(activation.Add(6*time.Hour), "")
+}
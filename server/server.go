@@ -1,13 +1,22 @@
 package server
 
 import (
+	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/netip"
+	"os"
+	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blang/semver"
@@ -16,22 +25,18 @@ import (
 
 	"github.com/getlantern/autoupdate-server/instrument"
 	"github.com/getlantern/golog"
-	"golang.org/x/time/rate"
 )
 
 const (
 	githubRefreshTime = 30 * time.Minute
+	// firstRefreshRetry is how long to wait before fetching the releases of
+	// an app again when they were never fetched.
+	firstRefreshRetry = 10 * time.Second
 	httpPathPrefix    = "/update"
 	appLantern        = "lantern"
-)
-
-var (
-	v360 = semver.MustParse("3.6.0")
-	// Windows XP/2003 or below
-	windowsXPMinus                 = semver.MustParse("6.0.0")
-	lastLanternVersionForWindowsXP = "5.4.1"
-	// 0SX 10.10 Yosemite or below
-	osxYosemiteMinus                 = semver.MustParse("15.0.0")
+	// Last versions of Lantern for old OS versions, unless configured
+	// otherwise, see defaultLanternRules.
+	lastLanternVersionForWindowsXP   = "5.4.1"
 	lastLanternVersionForOSXYosemite = "5.4.1"
 )
 
@@ -46,12 +51,14 @@ const (
 	INITIATIVE_MANUAL Initiative = "manual"
 )
 
-// PatchType represents the type of a binary patch, if any. Only bsdiff is supported
+// PatchType represents the type of a binary patch, if any. Archive patches
+// are only sent to clients that announce support for them.
 type PatchType string
 
 const (
-	PATCHTYPE_BSDIFF PatchType = "bsdiff"
-	PATCHTYPE_NONE   PatchType = ""
+	PATCHTYPE_BSDIFF  PatchType = "bsdiff"
+	PATCHTYPE_ARCHIVE PatchType = "archive"
+	PATCHTYPE_NONE    PatchType = ""
 )
 
 // Params represent parameters sent by the go-update client.
@@ -68,6 +75,8 @@ type Params struct {
 	OSVersion string `json:"os_version"`
 	// checksum of the binary to replace (used for returning diff patches)
 	Checksum string `json:"checksum"`
+	// application-level user identifier
+	UserID string `json:"user_id"`
 	// tags for custom update channels
 	Tags map[string]string `json:"tags"`
 }
@@ -80,7 +89,7 @@ type Result struct {
 	URL string `json:"url"`
 	// a URL to a patch to apply
 	PatchURL string `json:"patch_url"`
-	// the patch format (only bsdiff supported at the moment)
+	// the patch format (bsdiff or archive)
 	PatchType PatchType `json:"patch_type"`
 	// version of the new application
 	Version string `json:"version"`
@@ -88,11 +97,65 @@ type Result struct {
 	Checksum string `json:"checksum"`
 	// signature for verifying update authenticity
 	Signature string `json:"signature"`
+	// the client is below the minimum supported version and must update
+	Mandatory bool `json:"mandatory,omitempty"`
+	// ordered list of locations of the full update, including URL
+	URLs []string `json:"urls,omitempty"`
+	// ordered list of locations of the patch, including PatchURL
+	PatchURLs []string `json:"patch_urls,omitempty"`
+
+	size int64 // Expected size of the download.
 }
 
 // CheckForUpdate receives a *Params message and emits a *Result. If both res
-// and err are nil it means no update is available.
-func (g *ReleaseManager) CheckForUpdate(p *Params, isLantern bool) (res *Result, err error) {
+// and err are nil it means no update is available. Downloading assets and
+// generating patches are aborted once ctx is done, like when the client goes
+// away, or once the release manager is stopped.
+func (g *ReleaseManager) CheckForUpdate(ctx context.Context, p *Params, isLantern bool) (*Result, error) {
+	ctx, cancel := g.withLifetime(ctx)
+	defer cancel()
+	return g.decide(ctx, p, isLantern, &Decision{})
+}
+
+// withLifetime returns a context that is also cancelled when the release
+// manager is stopped.
+func (g *ReleaseManager) withLifetime(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(g.ctx, cancel)
+	if g.ctx.Err() != nil {
+		// AfterFunc would only cancel ctx asynchronously.
+		cancel()
+	}
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// decide checks for an update, recording how it was chosen in d.
+func (g *ReleaseManager) decide(ctx context.Context, p *Params, isLantern bool, d *Decision) (res *Result, err error) {
+	if res, err = g.checkForUpdate(ctx, p, isLantern, d); err != nil {
+		return nil, err
+	}
+	cfg := g.Config()
+	// Mirrors serve the paths of Github, so they are added before the URL is
+	// pointed to our own copy.
+	cfg.addMirrors(res, p.Tags["region"])
+	if cfg.ServeAssets {
+		fallbacks := res.URLs
+		if fallbacks == nil {
+			fallbacks = []string{res.URL}
+		}
+		res.URL = localAssetURL(g.publicAddr, res.Checksum, res.URL)
+		res.URLs = append([]string{res.URL}, fallbacks...)
+	}
+	return res, nil
+}
+
+func (g *ReleaseManager) checkForUpdate(ctx context.Context, p *Params, isLantern bool, d *Decision) (res *Result, err error) {
+	// The lookup ends where patch generation starts.
+	_, lookup := instrument.Start(ctx, "lookup")
+	defer lookup.End()
 
 	// Keep for the future.
 	if p.Version < 1 {
@@ -138,22 +201,114 @@ func (g *ReleaseManager) CheckForUpdate(p *Params, isLantern bool) (res *Result,
 		return nil, fmt.Errorf("bad app version string %v: %v", p.AppVersion, err)
 	}
 
+	cfg := g.Config()
+	channel := cfg.channel(p.Tags[channelTag])
+	clientID := cfg.clientID(p)
+	cohort := cfg.cohort(p)
+	d.Channel, d.Cohort, d.ClientID = channel.Name, cohort, clientID
+	d.tracef("Client %q of cohort %q is on channel %s", clientID, cohort, channel.Name)
+
+	now := g.clock()
+
+	// Clients can get releases of their channel that are active and not
+	// blocked or paused and that are rolled out to their cohort and to them.
+	eligible := func(a *Asset) bool {
+		return channel.includes(a) && cfg.isActive(a.v, now) && !cfg.isBlocked(a) && !cfg.isPaused(a.v) &&
+			cfg.inRolloutCohorts(a.v, cohort) && cfg.inRollout(a.v, clientID)
+	}
+
 	var update *Asset
-	if isLantern {
-		if update, err = g.specificLanternVersionToUpgrade(p); err != nil {
-			return nil, fmt.Errorf("no upgrade for version %s %s/%s: %v", p.AppVersion, p.OS, p.Arch, err)
+	rule := cfg.matchRule(p, appVersion, isLantern)
+	if d.DryRun {
+		d.MatchedRules = cfg.matchingRuleNames(p, appVersion, isLantern)
+	}
+	defer func() {
+		if res != nil {
+			res.Initiative, res.Mandatory = cfg.initiative(rule, update.v, appVersion)
+			d.tracef("Offering %s with initiative %s (mandatory: %v)", res.Version, res.Initiative, res.Mandatory)
+		}
+		if update != nil {
+			a := catalogAsset(update)
+			d.Update = &a
+		}
+	}()
+
+	// Clients running a release that is rolled back go back to the previous
+	// good one, even though it's older.
+	rollback := false
+	if target, ok := cfg.rollbackTarget(appVersion); ok {
+		if update, err = g.lookupAssetWithVersion(p.OS, p.Arch, target); err != nil {
+			log.Errorf("Could not find rollback target %s for %s %s/%s: %v", target, p.AppVersion, p.OS, p.Arch, err)
+		} else {
+			log.Debugf("Rolling back %s %s/%s to %s", p.AppVersion, p.OS, p.Arch, target)
+			rollback = true
+			d.Rollback = target
+			d.tracef("Release %s is rolled back to %s", p.AppVersion, target)
 		}
 	}
 
-	// Looking if there is a newer version for the os/arch.
+	// Rollbacks can't wait for the next update window.
+	if !rollback && !cfg.inUpdateWindow(p.Tags["region"], now) {
+		d.tracef("Outside of the update windows of region %q", p.Tags["region"])
+		return nil, ErrNoUpdateAvailable
+	}
+
+	if rule != nil && !rollback {
+		log.Debugf("Rule %q (%s) applies to %s %s/%s", rule.Name, rule.Action, p.AppVersion, p.OS, p.Arch)
+		d.tracef("Rule %q (%s %s) applies", rule.Name, rule.Action, rule.Version)
+		switch rule.Action {
+		case RULEACTION_BLOCK:
+			return nil, ErrNoUpdateAvailable
+		case RULEACTION_PIN:
+			if update, err = g.lookupAssetWithVersion(p.OS, p.Arch, rule.Version); err != nil {
+				return nil, fmt.Errorf("no upgrade for version %s %s/%s: %v", p.AppVersion, p.OS, p.Arch, err)
+			}
+			if !cfg.isActive(update.v, now) || cfg.isBlocked(update) || cfg.isPaused(update.v) {
+				d.tracef("Pinned release %s is not offered", update.v)
+				update = nil
+				return nil, ErrNoUpdateAvailable
+			}
+		case RULEACTION_CAP:
+			maxVersion, err := semver.Parse(rule.Version)
+			if err != nil {
+				return nil, fmt.Errorf("bad version %q in rule %s: %v", rule.Version, rule.Name, err)
+			}
+			if update, err = g.lookupLatestAsset(p.OS, p.Arch, func(a *Asset) bool {
+				return a.v.LTE(maxVersion) && eligible(a)
+			}); err != nil {
+				d.tracef("No eligible release up to %s", maxVersion)
+				return nil, ErrNoUpdateAvailable
+			}
+		}
+	}
+
+	// Looking if there is a newer version for the os/arch on the client's
+	// channel.
 	if update == nil {
-		if update, err = g.getProductUpdate(p.OS, p.Arch); err != nil {
+		if update, err = g.getProductUpdate(channel.Name, p.OS, p.Arch); err == ErrNoUpdateAvailable {
+			d.tracef("No release on channel %s", channel.Name)
+			return nil, err
+		} else if err != nil {
 			return nil, fmt.Errorf("could not lookup for updates: %s", err)
 		}
+		d.Latest = update.v.String()
+
+		// Clients left out of the rollout of the latest release, or if it's
+		// paused, get the newest release they are eligible for.
+		if !eligible(update) {
+			d.tracef("Latest release %s is not offered: %s", update.v, ineligibility(cfg, channel, cohort, clientID, now, update))
+			if update, err = g.lookupLatestAsset(p.OS, p.Arch, eligible); err != nil {
+				d.tracef("No other eligible release")
+				return nil, ErrNoUpdateAvailable
+			}
+		}
 	}
 
-	// No update available.
-	if update.v.LTE(appVersion) {
+	// No update available. This also keeps clients that switched to a channel
+	// with older releases on their version.
+	if !rollback && update.v.LTE(appVersion) {
+		d.tracef("Release %s is not newer than %s", update.v, appVersion)
+		update = nil
 		return nil, ErrNoUpdateAvailable
 	}
 
@@ -164,51 +319,156 @@ func (g *ReleaseManager) CheckForUpdate(p *Params, isLantern bool) (res *Result,
 	if current, err = g.lookupAssetWithChecksum(p.OS, p.Arch, p.Checksum); err != nil {
 		// No such asset with the given checksum, nothing to compare. Tell the
 		// client to download the full binary
-		r := &Result{
-			Initiative: INITIATIVE_AUTO,
-			URL:        update.URL,
-			PatchType:  PATCHTYPE_NONE,
-			Version:    update.v.String(),
-			Checksum:   update.Checksum,
-			Signature:  update.Signature,
-		}
+		d.tracef("No release matches checksum %s, offering the full update", p.Checksum)
+		return fullUpdateResult(update), nil
+	}
+	c := catalogAsset(current)
+	d.Current = &c
+	lookup.SetAttributes(attribute.String("current", current.v.String()), attribute.String("update", update.v.String()))
+	lookup.End()
+
+	patchFor := g.patchFor
+	if d.DryRun {
+		patchFor = g.findPatch(d)
+	}
 
-		return r, nil
+	// Generate a binary diff of the two assets, unless we already have one.
+	var patch *PatchInfo
+	if current.Format.isArchive() && current.Format == update.Format && p.acceptsPatchType(PATCHTYPE_ARCHIVE) {
+		if patch, err = patchFor(ctx, current, update, PATCHTYPE_ARCHIVE); err != nil {
+			log.Errorf("Unable to generate archive patch, falling back: %v", err)
+		}
 	}
+	if patch == nil {
+		if patch, err = patchFor(ctx, current, update, PATCHTYPE_BSDIFF); err != nil {
+			return nil, fmt.Errorf("unable to generate patch: %q", err)
+		}
+	}
+	if !d.DryRun {
+		d.PatchExists = true
+	}
+	d.PatchType, d.PatchName = patch.Type, patch.Name
+	d.tracef("Offering %s patch %s from %s (exists: %v)", patch.Type, patch.Name, current.v, d.PatchExists)
 
-	// Generate a binary diff of the two assets.
-	var patch *Patch
-	if patch, err = generatePatch(current.URL, update.URL); err != nil {
-		return nil, fmt.Errorf("unable to generate patch: %q", err)
+	var patchURL string
+	if patchURL, err = g.storage.URL(patch.Name); err != nil {
+		return nil, fmt.Errorf("unable to get patch URL: %v", err)
 	}
 
 	// Generate result with the patch URL.
 	r := &Result{
 		Initiative: INITIATIVE_AUTO,
 		URL:        update.URL,
-		PatchURL:   patch.File,
-		PatchType:  PATCHTYPE_BSDIFF,
+		PatchURL:   patchURL,
+		PatchType:  patch.Type,
 		Version:    update.v.String(),
 		Checksum:   update.Checksum,
 		Signature:  update.Signature,
+		size:       patch.Size,
 	}
 
 	return r, nil
 }
 
-func (g *ReleaseManager) specificLanternVersionToUpgrade(p *Params) (*Asset, error) {
-	var specificVersion string
-	if osVersion, err := semver.Parse(p.OSVersion); err == nil {
-		if p.OS == "windows" && osVersion.LT(windowsXPMinus) {
-			specificVersion = lastLanternVersionForWindowsXP
-		} else if p.OS == "darwin" && osVersion.LT(osxYosemiteMinus) {
-			specificVersion = lastLanternVersionForOSXYosemite
+// patchFor looks up a patch from current to update in the patch store,
+// generating it if it's not there yet, and makes sure it's published to the
+// patch storage.
+func (g *ReleaseManager) patchFor(ctx context.Context, current *Asset, update *Asset, patchType PatchType) (*PatchInfo, error) {
+	info, ok := g.patches.Find(current.Checksum, update.Checksum, patchType)
+	if !ok {
+		var err error
+		if info, err = g.createPatch(ctx, current, update, patchType); err != nil {
+			return nil, err
+		}
+	}
+
+	if info.Storage != g.storage.ID() {
+		if err := g.storage.Put(ctx, info.Name, g.patches.File(info.Name)); err != nil {
+			return nil, err
 		}
+		info.Storage = g.storage.ID()
+		if err := g.patches.Put(info); err != nil {
+			log.Errorf("Could not store metadata of patch %s: %v", info.Name, err)
+		}
+	}
+
+	return info, nil
+}
+
+// createPatch generates a patch from current to update and records it in the
+// patch store.
+func (g *ReleaseManager) createPatch(ctx context.Context, current *Asset, update *Asset, patchType PatchType) (*PatchInfo, error) {
+	start := time.Now()
+	ctx, span := instrument.Start(ctx, "diff")
+	defer span.End()
+	span.SetAttributes(attribute.String("patchType", string(patchType)))
+
+	var err error
+	var patch *Patch
+	if patchType == PATCHTYPE_ARCHIVE {
+		patch, err = generateArchivePatch(ctx, current.URL, update.URL, update.Format)
+	} else {
+		patch, err = generatePatch(ctx, current.URL, update.URL)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	info := &PatchInfo{
+		Name:           path.Base(patch.File),
+		App:            g.owner + "/" + g.repo,
+		Type:           patch.Type,
+		Format:         update.Format,
+		SourceVersion:  current.v.String(),
+		SourceChecksum: current.Checksum,
+		SourceSize:     fileSize(patch.oldfile),
+		TargetVersion:  update.v.String(),
+		TargetChecksum: update.Checksum,
+		TargetSize:     fileSize(patch.newfile),
+		Size:           fileSize(patch.File),
+		Duration:       time.Since(start),
+		CreatedAt:      time.Now(),
+	}
+	if info.Checksum, err = checksumForFile(patch.File); err != nil {
+		return nil, err
+	}
+
+	if err = g.patches.Put(info); err != nil {
+		log.Errorf("Could not store metadata of patch %s: %v", info.Name, err)
+	}
+
+	return info, nil
+}
+
+// fullUpdateResult tells the client to download the full binary.
+func fullUpdateResult(update *Asset) *Result {
+	return &Result{
+		Initiative: INITIATIVE_AUTO,
+		URL:        update.URL,
+		PatchType:  PATCHTYPE_NONE,
+		Version:    update.v.String(),
+		Checksum:   update.Checksum,
+		Signature:  update.Signature,
+		size:       fileSize(update.LocalFile),
 	}
-	if specificVersion != "" {
-		return g.lookupAssetWithVersion(p.OS, p.Arch, specificVersion)
+}
+
+// acceptsPatchType returns true if the client can apply patches of the given
+// type. Clients list the patch types they support in the "patch_types" tag,
+// old clients that don't send it only know about bsdiff.
+func (p *Params) acceptsPatchType(t PatchType) bool {
+	supported := p.Tags["patch_types"]
+	if supported == "" {
+		return t == PATCHTYPE_BSDIFF
+	}
+	for _, s := range strings.Split(supported, ",") {
+		if PatchType(strings.TrimSpace(s)) == t {
+			return true
+		}
 	}
-	return nil, nil
+	return false
 }
 
 type UpdateServer struct {
@@ -216,63 +476,206 @@ type UpdateServer struct {
 	localAddr        string
 	mux              *http.ServeMux
 	patchesDirectory string
+	patchStorage     PatchStorage
 	publicAddr       string
-	rateLimit        rate.Limit
-	limiter          *rate.Limiter
+	rateLimit        RateLimit
+	appConfigs       map[string]*AppConfig
+	// config is the configuration last applied, see ApplyConfig.
+	config        *Config
+	geoIP         atomic.Pointer[GeoIPDB]
+	catalogMaxAge time.Duration
+	// trustedProxies are the proxies whose X-Forwarded-For headers are
+	// honored when locating clients.
+	trustedProxies atomic.Pointer[[]netip.Prefix]
+	// middleware wraps the handlers of apps.
+	middleware func(next http.Handler) http.Handler
+	// newReleaseManager creates the release managers of apps,
+	// NewReleaseManager by default.
+	newReleaseManager func(owner string, repo string) *ReleaseManager
+	// Release managers by the path segment of their app after /update/,
+	// empty for /update itself, along with their handlers and the channels
+	// stopping their background refreshes. Apps can be added and removed
+	// while serving, see AddApp.
+	apps     map[string]*ReleaseManager
+	handlers map[string]http.Handler
+	stops    map[string]chan struct{}
+	// Release managers of the apps replaced or removed, stopped once the
+	// requests they are handling complete.
+	retired map[*ReleaseManager]struct{}
+	// HTTP servers started by ListenAndServe and ListenAndServeAdmin, and
+	// the background refreshes running, see Shutdown.
+	servers   []*http.Server
+	refreshes sync.WaitGroup
+	closing   bool
+	closeOnce sync.Once
+	mu        sync.RWMutex
 }
 
 func NewUpdateServer(publicAddr, localAddr, localpatchesDirectory string, rateLimit int) *UpdateServer {
 	u := &UpdateServer{
-		chClose:          make(chan struct{}),
-		localAddr:        localAddr,
-		patchesDirectory: localpatchesDirectory,
-		publicAddr:       publicAddr,
-		rateLimit:        rate.Limit(rateLimit),
+		chClose:           make(chan struct{}),
+		localAddr:         localAddr,
+		patchesDirectory:  localpatchesDirectory,
+		patchStorage:      &LocalPatchStorage{PublicAddr: publicAddr},
+		publicAddr:        publicAddr,
+		rateLimit:         RateLimit{UpdatesPerSecond: float64(rateLimit)},
+		appConfigs:        make(map[string]*AppConfig),
+		catalogMaxAge:     defaultCatalogMaxAge,
+		apps:              make(map[string]*ReleaseManager),
+		handlers:          make(map[string]http.Handler),
+		stops:             make(map[string]chan struct{}),
+		retired:           make(map[*ReleaseManager]struct{}),
+		newReleaseManager: NewReleaseManager,
 	}
-	if u.rateLimit == 0 {
-		u.rateLimit = rate.Inf
-	}
-	u.limiter = rate.NewLimiter(u.rateLimit, int(u.rateLimit))
 	u.mux = http.NewServeMux()
-	u.mux.Handle("/patches/", http.StripPrefix("/patches/", http.FileServer(http.Dir(u.patchesDirectory))))
+	u.mux.Handle(httpPathPrefix, u.appsHandler())
+	u.mux.Handle(httpPathPrefix+"/", u.appsHandler())
+	u.mux.Handle("/"+patchesDirectory, http.StripPrefix("/"+patchesDirectory, u.patchesHandler()))
+	u.mux.Handle("/"+assetsPath, http.StripPrefix("/"+assetsPath, u.assetsHandler()))
+	u.mux.Handle(metricsPath, MetricsHandler())
+	u.mux.Handle(healthzPath, healthzHandler())
+	u.mux.Handle(readyzPath, u.readyzHandler())
 	return u
 }
 
-func (u *UpdateServer) HandleRepo(app, owner, repo string, otelHandler func(next http.Handler) http.Handler) {
-	path := httpPathPrefix
-	if app != "" {
-		path = path + "/" + app
-	} else {
-		app = appLantern
+// assetsHandler serves the copies of update assets cached by the release
+// managers, addressed by checksum.
+func (u *UpdateServer) assetsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checksum, name, _ := strings.Cut(r.URL.Path, "/")
+		var asset *Asset
+		for _, rm := range u.releaseManagers() {
+			if asset = rm.lookupCachedAsset(checksum); asset != nil {
+				break
+			}
+		}
+		if asset == nil || localAssetName(asset.URL) != name {
+			http.NotFound(w, r)
+			return
+		}
+
+		fp, err := os.Open(asset.LocalFile)
+		if err != nil {
+			log.Errorf("Could not open cached asset %s: %v", asset.LocalFile, err)
+			http.NotFound(w, r)
+			return
+		}
+		defer fp.Close()
+
+		// Assets are addressed by checksum, they never change.
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", `"`+asset.Checksum+`"`)
+		w.Header().Set("Vary", "Accept-Encoding")
+
+		// Cached copies are stored uncompressed, compress them on the fly for
+		// clients that accept it, unless they want a range.
+		if r.Header.Get("Range") == "" && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			if r.Header.Get("If-None-Match") == w.Header().Get("ETag") {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			if r.Method == http.MethodHead {
+				return
+			}
+			gw := gzip.NewWriter(w)
+			if _, err = io.Copy(gw, fp); err == nil {
+				err = gw.Close()
+			}
+			if err != nil {
+				log.Debugf("Unable to write asset %s: %v", name, err)
+			}
+			return
+		}
+		http.ServeContent(w, r, name, time.Time{}, fp)
+	})
+}
+
+// SetPatchStorage sets where patches are published for clients to download
+// them. It must be called before HandleRepo.
+func (u *UpdateServer) SetPatchStorage(storage PatchStorage) {
+	u.patchStorage = storage
+}
+
+// SetGeoIPDB sets the database used to locate clients that don't send their
+// country or ISP. It's safe to call it while serving requests.
+func (u *UpdateServer) SetGeoIPDB(db *GeoIPDB) {
+	u.geoIP.Store(db)
+}
+
+// SetTrustedProxies sets the proxies in front of the server. Clients are only
+// located by the X-Forwarded-For header of requests coming from them. It's
+// safe to call it while serving requests.
+func (u *UpdateServer) SetTrustedProxies(proxies []netip.Prefix) {
+	u.trustedProxies.Store(&proxies)
+}
+
+func (u *UpdateServer) trusted() []netip.Prefix {
+	if proxies := u.trustedProxies.Load(); proxies != nil {
+		return *proxies
 	}
-	log.Debugf("HTTP path %q maps to repo %s/%s", path, owner, repo)
-	u.mux.Handle(path, otelHandler(u.handlerFor(app, owner, repo)))
+	return nil
+}
+
+// SetAppConfig sets the settings of the given app. It must be called before
+// HandleRepo.
+func (u *UpdateServer) SetAppConfig(app string, cfg *AppConfig) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.appConfigs[app] = cfg
+}
+
+// SetMiddleware sets the middleware wrapping the handlers of apps, like
+// tracing. It must be called before adding apps.
+func (u *UpdateServer) SetMiddleware(middleware func(next http.Handler) http.Handler) {
+	u.middleware = middleware
 }
 
-func (u *UpdateServer) handlerFor(app, owner, repo string) http.Handler {
-	releaseManager := NewReleaseManager(owner, repo)
-	// Getting assets...
-	if err := releaseManager.UpdateAssetsMap(); err != nil {
+// appConfig returns the settings of the app served under the given name.
+// /update uses the settings of lantern unless it has its own. It must be
+// called with u.mu held.
+func (u *UpdateServer) appConfig(name string) *AppConfig {
+	if cfg, ok := u.appConfigs[name]; ok || name != "" {
+		return cfg
+	}
+	return u.appConfigs[appLantern]
+}
+
+// HandleRepo serves the releases of the given Github repo under
+// /update/<app>, or /update if app is empty. The releases are fetched in the
+// background, the app is not ready until they are, see /readyz.
+func (u *UpdateServer) HandleRepo(app, owner, repo string, otelHandler func(next http.Handler) http.Handler) {
+	if u.middleware == nil {
+		u.middleware = otelHandler
+	}
+	u.mu.RLock()
+	cfg := u.appConfig(app)
+	storage, rateLimit := u.patchStorage, u.rateLimit
+	u.mu.RUnlock()
+	if err := u.installApp(app, u.newApp(app, owner, repo, cfg, storage, rateLimit)); err != nil {
 		// In this case we will not be able to continue.
 		log.Fatal(err)
 	}
-	// Setting a goroutine for pulling updates periodically
-	go u.backgroundUpdate(releaseManager)
+}
 
-	//u.configureHoneycomb(context.Background())
+// handlerFor returns the handler of update requests for the app served under
+// the given name.
+func (u *UpdateServer) handlerFor(name string, releaseManager *ReleaseManager) http.Handler {
+	app := name
+	if app == "" {
+		app = appLantern
+	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		c := r.Context()
-		userID := userIDFromRequest(c)
-		_, span := instrument.Tracer.Start(c, "autoupdate_download")
+		ctx, span := instrument.Start(r.Context(), "autoupdate_download")
 		defer span.End()
-		span.SetAttributes(attribute.Int64("userId", userID))
 
 		var err error
 		var res *Result
 
-		recordError := func(w http.ResponseWriter, statusCode int, args ...any) {
-			msg := fmt.Sprintf("%s", args...)
+		recordError := func(w http.ResponseWriter, statusCode int, format string, args ...any) {
+			msg := fmt.Sprintf(format, args...)
 			log.Error(msg)
 			span.RecordError(errors.New(msg))
 			span.SetStatus(codes.Error, msg)
@@ -286,21 +689,33 @@ func (u *UpdateServer) handlerFor(app, owner, repo string) http.Handler {
 		defer r.Body.Close()
 
 		var params Params
+		result := CHECKRESULT_ERROR
+		defer func() { countUpdateCheck(app, &params, result) }()
 		decoder := json.NewDecoder(r.Body)
 
 		if err = decoder.Decode(&params); err != nil {
 			recordError(w, http.StatusBadRequest, "JSON decode error")
 			return
 		}
+		if params.UserID == "" {
+			params.UserID = r.Header.Get(userIDHeader)
+		}
+		span.SetAttributes(attribute.Int64("userId", numericUserID(params.UserID)))
+		if db := u.geoIP.Load(); db != nil {
+			db.locate(&params, r, u.trusted())
+		}
 
 		span.SetAttributes(attribute.String("appVersion", params.AppVersion))
 		span.SetAttributes(attribute.String("arch", params.Arch))
 		span.SetAttributes(attribute.String("platform", params.OS))
+		span.SetAttributes(attribute.String("channel", params.Tags[channelTag]))
+		span.SetAttributes(attribute.String("cohort", releaseManager.Config().cohort(&params)))
 
 		isLantern := app == appLantern
-		if res, err = releaseManager.CheckForUpdate(&params, isLantern); err != nil {
+		if res, err = releaseManager.CheckForUpdate(ctx, &params, isLantern); err != nil {
 			if err == ErrNoUpdateAvailable {
 				log.Debugf("No update available for: %s/%s/%s", app, params.OS, params.AppVersion)
+				result = CHECKRESULT_NO_UPDATE
 				closeWithStatus(w, http.StatusNoContent)
 				return
 			}
@@ -308,46 +723,47 @@ func (u *UpdateServer) handlerFor(app, owner, repo string) http.Handler {
 			return
 		}
 
-		if !u.limiter.Allow() {
-			recordError(w, http.StatusNoContent, "Update skipped because current rate limit (%.0f/s) is hit.", u.rateLimit)
+		if ok, wait := releaseManager.allowUpdate(res); !ok {
+			// Let clients know when to come back instead of having them retry
+			// right away.
+			w.Header().Set("Retry-After", retryAfter(wait))
+			result = CHECKRESULT_RATE_LIMITED
+			rateLimitRejections.WithLabelValues(app, res.Version).Inc()
+			// Holding updates back is intended, not a failure.
+			log.Debugf("Update of %s to %s skipped because its rate limit is hit.", app, res.Version)
+			span.SetAttributes(attribute.Bool("rateLimited", true))
+			closeWithStatus(w, http.StatusNoContent)
 			return
 		}
 
-		if isLantern && params.OS == "darwin" {
-			currentVersion, err := semver.Parse(params.AppVersion)
-			if err != nil {
-				recordError(w, http.StatusNoContent, "Failed to parse version (%q): %v", params.AppVersion, err)
-				return
-			}
-			if currentVersion.LT(v360) {
-				recordError(w, http.StatusNoContent, "Got %q version %q on OSX, but we cannot update it. Skipped", app, params.AppVersion)
-				return
-			}
-		}
+		span.SetAttributes(attribute.String("initiative", string(res.Initiative)))
+		span.SetAttributes(attribute.Bool("mandatory", res.Mandatory))
 
 		log.Debugf("Got query from client %q/%q/%q, resolved to upgrade to %q using %q strategy.", app, params.AppVersion, params.OS, res.Version, res.PatchType)
 
-		if res.PatchURL != "" {
-			res.PatchURL = u.publicAddr + res.PatchURL
-		}
-
 		var content []byte
 		if content, err = json.Marshal(res); err != nil {
 			log.Debugf("Failed to marshal response: %s", err)
-			recordError(w, http.StatusInternalServerError, "Failed to marshal response: %w", err)
+			recordError(w, http.StatusInternalServerError, "Failed to marshal response: %v", err)
 			return
 		}
 
 		nonce, _ := strconv.ParseInt(r.Header.Get("X-Message-Nonce"), 10, 64) // Can be zero for old clients.
 		hash := sha256.Sum256(append(content, []byte(fmt.Sprintf("%d", nonce))...))
+		_, signing := instrument.Start(ctx, "sign")
 		messageAuth, err := Sign(hash[:])
+		signing.End()
 		if err != nil {
-			recordError(w, http.StatusInternalServerError, "Could not sign body: %w", err)
+			recordError(w, http.StatusInternalServerError, "Could not sign body: %v", err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("X-Message-Signature", hex.EncodeToString(messageAuth))
+		result = CHECKRESULT_FULL
+		if res.PatchType != PATCHTYPE_NONE {
+			result = CHECKRESULT_PATCH
+		}
 
 		if _, err := w.Write(content); err != nil {
 			log.Debugf("Unable to write response: %s", err)
@@ -355,34 +771,49 @@ func (u *UpdateServer) handlerFor(app, owner, repo string) http.Handler {
 	})
 }
 
+// ListenAndServe serves updates until the server is shut down or closed, in
+// which case it returns http.ErrServerClosed.
 func (u *UpdateServer) ListenAndServe() error {
-	srv := http.Server{
+	srv := &http.Server{
 		Addr:    u.localAddr,
 		Handler: u.mux,
 	}
 	log.Debugf("Starting up HTTP server at %s.", u.localAddr)
-	go func() {
-		<-u.chClose
-		log.Debugf("Closing HTTP server at %s.", u.localAddr)
-		_ = srv.Close()
-	}()
-	return srv.ListenAndServe()
-}
-
-func (u *UpdateServer) Close() {
-	close(u.chClose)
+	return u.listenAndServe(srv)
 }
 
-// backgroundUpdate periodically looks for releases.
-func (u *UpdateServer) backgroundUpdate(releaseManager *ReleaseManager) {
+// backgroundUpdate periodically looks for releases until stop is closed or
+// the server is closed.
+func (u *UpdateServer) backgroundUpdate(releaseManager *ReleaseManager, stop chan struct{}) {
+	defer u.refreshes.Done()
+	// Apps installed before their releases were fetched, like at startup,
+	// are refreshed right away, and again after firstRefreshRetry until
+	// it succeeds.
+	for !releaseManager.refreshed() {
+		err := releaseManager.UpdateAssetsMap(context.Background())
+		if err == nil {
+			break
+		}
+		log.Errorf("Could not get releases of %s/%s, retrying in %v: %v", releaseManager.owner, releaseManager.repo, firstRefreshRetry, err)
+		select {
+		case <-time.After(firstRefreshRetry):
+		case <-stop:
+			return
+		case <-u.chClose:
+			return
+		}
+	}
 	tk := time.NewTicker(githubRefreshTime)
+	defer tk.Stop()
 	for {
 		select {
 		case <-tk.C:
 			log.Debug("Updating assets...")
-			if err := releaseManager.UpdateAssetsMap(); err != nil {
+			if err := releaseManager.UpdateAssetsMap(context.Background()); err != nil {
 				log.Debugf("updateAssets: %s", err)
 			}
+		case <-stop:
+			return
 		case <-u.chClose:
 			return
 		}
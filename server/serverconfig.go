@@ -0,0 +1,422 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// How often the configuration file is checked for changes.
+const configPollInterval = 10 * time.Second
+
+// Config is the configuration of the update server. It's read from a YAML or
+// JSON file and can be reloaded while serving, see WatchConfig.
+type Config struct {
+	// PublicAddr and LocalAddr are the public URL and the local bind address
+	// of the server. Changes take effect on restart.
+	PublicAddr string `json:"public_addr,omitempty"`
+	LocalAddr  string `json:"local_addr,omitempty"`
+	// PrivateKey is the path to the key updates and responses are signed
+	// with. Changes take effect on restart, since the signatures of the
+	// assets already fetched were made with the current key.
+	PrivateKey string `json:"private_key,omitempty"`
+	// RateLimit applies to the apps whose settings don't set one.
+	RateLimit RateLimit `json:"rate_limit,omitempty"`
+	// Storage is where patches are published. Changes take effect on
+	// restart.
+	Storage StorageConfig `json:"storage,omitempty"`
+	// GeoIPDB is the path to a CSV file mapping IP ranges to countries and
+	// ISPs, see GeoIPDB.
+	GeoIPDB string `json:"geoip_db,omitempty"`
+	// TrustedProxies are the addresses or networks of the proxies in front of
+	// the server, whose X-Forwarded-For headers are honored when locating
+	// clients.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	// Tracing is where traces are exported. Changes take effect on restart.
+	Tracing TracingConfig `json:"tracing,omitempty"`
+	// Apps are the apps served, keyed by the path segment after /update/.
+	// The app with an empty name is served at /update.
+	Apps map[string]*App `json:"apps"`
+}
+
+// App is an app served by the update server.
+type App struct {
+	// Source is the Github repo the releases of the app are pulled from, like
+	// "getlantern/lantern".
+	Source string `json:"source"`
+	AppConfig
+}
+
+// Repo returns the owner and the name of the Github repo of the app.
+func (a *App) Repo() (owner string, repo string) {
+	owner, repo, _ = strings.Cut(a.Source, "/")
+	return owner, repo
+}
+
+func (a *App) validate() error {
+	if owner, repo := a.Repo(); owner == "" || repo == "" || strings.Contains(repo, "/") {
+		return fmt.Errorf("expecting a source in 'owner/repo' format, got %q", a.Source)
+	}
+	return a.AppConfig.Validate()
+}
+
+// StorageConfig describes where patches are published.
+type StorageConfig struct {
+	// Type is either "local" to serve patches from this server, the default,
+	// or "s3" to upload them to an S3-compatible bucket. S3 credentials are
+	// read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+	Type string `json:"type,omitempty"`
+	// Endpoint is the base URL of the S3 API, https://s3.amazonaws.com by
+	// default.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Region defaults to us-east-1.
+	Region string `json:"region,omitempty"`
+	Bucket string `json:"bucket,omitempty"`
+	// Prefix of the keys of uploaded patches.
+	Prefix    string `json:"prefix,omitempty"`
+	PathStyle bool   `json:"path_style,omitempty"`
+	// PublicURL is the base URL of the CDN serving the bucket. Clients get
+	// presigned URLs if empty.
+	PublicURL string `json:"public_url,omitempty"`
+}
+
+// TracingConfig describes where and how much traces are exported to an
+// OpenTelemetry collector.
+type TracingConfig struct {
+	// Disabled turns tracing off.
+	Disabled bool `json:"disabled,omitempty"`
+	// Endpoint is the host:port of the collector, Honeycomb by default.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Protocol is either "http", the default, or "grpc".
+	Protocol string `json:"protocol,omitempty"`
+	// Insecure exports traces without TLS, like to a local collector.
+	Insecure bool `json:"insecure,omitempty"`
+	// Headers are sent along with traces, like API keys.
+	Headers map[string]string `json:"headers,omitempty"`
+	// SampleRatio is the fraction of traces kept, from 0 to 1. All are kept
+	// if unset. It only applies to the traces clients haven't decided to
+	// sample: requests whose traceparent header marks the client's span as
+	// sampled are always traced, whatever the ratio.
+	SampleRatio *float64 `json:"sample_ratio,omitempty"`
+}
+
+func (t *TracingConfig) validate() error {
+	switch t.Protocol {
+	case "", "http", "grpc":
+	default:
+		return fmt.Errorf("unknown tracing protocol %q", t.Protocol)
+	}
+	if t.SampleRatio != nil && (*t.SampleRatio < 0 || *t.SampleRatio > 1) {
+		return fmt.Errorf("sample ratio must be between 0 and 1, got %v", *t.SampleRatio)
+	}
+	return nil
+}
+
+func (s *StorageConfig) validate() error {
+	switch s.Type {
+	case "", "local":
+		return nil
+	case "s3":
+		if s.Bucket == "" {
+			return fmt.Errorf("a bucket is required to publish patches to S3")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown patch storage %q", s.Type)
+}
+
+// PatchStorage returns the storage described by s.
+func (s *StorageConfig) PatchStorage(publicAddr string) PatchStorage {
+	if s.Type != "s3" {
+		return &LocalPatchStorage{PublicAddr: publicAddr}
+	}
+	storage := &S3PatchStorage{
+		Endpoint:        s.Endpoint,
+		Region:          s.Region,
+		Bucket:          s.Bucket,
+		Prefix:          s.Prefix,
+		PathStyle:       s.PathStyle,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		PublicURL:       s.PublicURL,
+	}
+	if storage.Endpoint == "" {
+		storage.Endpoint = "https://s3.amazonaws.com"
+	}
+	if storage.Region == "" {
+		storage.Region = "us-east-1"
+	}
+	return storage
+}
+
+// LoadConfig reads and validates a configuration file. Files ending in .yaml
+// or .yml are read as YAML, others as JSON.
+func LoadConfig(file string) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		// Go through JSON so that the same field names apply to both formats.
+		var v any
+		if err = yaml.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("Could not parse config %s: %v", file, err)
+		}
+		if b, err = json.Marshal(v); err != nil {
+			return nil, fmt.Errorf("Could not parse config %s: %v", file, err)
+		}
+	}
+
+	cfg := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("Could not parse config %s: %v", file, err)
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %v", file, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks that the configuration is consistent.
+func (c *Config) Validate() error {
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+	if err := c.Storage.validate(); err != nil {
+		return err
+	}
+	if err := c.Tracing.validate(); err != nil {
+		return err
+	}
+	if _, err := ParseTrustedProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+	for name, app := range c.Apps {
+		if strings.Contains(name, "/") {
+			return fmt.Errorf("app name %q must not contain slashes", name)
+		}
+		if app == nil {
+			return fmt.Errorf("app %q has no settings", name)
+		}
+		if err := app.validate(); err != nil {
+			return fmt.Errorf("invalid app %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// ApplyConfig applies a configuration to the server. The files it refers to
+// are read and the releases of new apps and of apps whose source changed are
+// fetched first, so that the server is left untouched if any of them fails.
+// Apps already served then get their new settings right away, without
+// downloading their assets again. Apps removed from the configuration stop
+// being served, except for the one served at /update which falls back to -o
+// and -n. Apps added with AddApp under names the configuration doesn't use
+// are left alone.
+func (u *UpdateServer) ApplyConfig(cfg *Config) error {
+	return u.applyConfig(cfg, true)
+}
+
+// ApplyInitialConfig applies the configuration the server starts with. Unlike
+// ApplyConfig, it doesn't wait for the releases of the apps: they are fetched
+// in the background and /readyz fails until they are, so that the server can
+// answer probes while it boots.
+func (u *UpdateServer) ApplyInitialConfig(cfg *Config) error {
+	return u.applyConfig(cfg, false)
+}
+
+// applyConfig applies a configuration to the server, fetching the releases of
+// new apps first if fetch is set.
+func (u *UpdateServer) applyConfig(cfg *Config, fetch bool) error {
+	var err error
+	var db *GeoIPDB
+	if cfg.GeoIPDB != "" {
+		if db, err = LoadGeoIPDB(cfg.GeoIPDB); err != nil {
+			return err
+		}
+	}
+	trustedProxies, err := ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	u.mu.RLock()
+	previous := u.config
+	// Assets are uploaded to the storage the server started with.
+	storage := u.patchStorage
+	started := previous != nil || len(u.apps) > 0
+	u.mu.RUnlock()
+	if previous != nil {
+		warnRestartRequired(previous, cfg)
+	}
+	if configured := cfg.Storage.PatchStorage(u.publicAddr); !started {
+		storage = configured
+	} else if previous == nil && configured.ID() != storage.ID() {
+		log.Errorf("Patch storage changed to %s, restart to apply", configured.ID())
+	}
+
+	prepared := make(map[string]*preparedApp)
+	stopPrepared := func() {
+		for _, app := range prepared {
+			app.releaseManager.Stop()
+		}
+	}
+	// Apps can be added or removed with the admin API while the releases
+	// are fetched, so check what's missing again once they are.
+	u.mu.Lock()
+	for {
+		if u.closing {
+			u.mu.Unlock()
+			stopPrepared()
+			return fmt.Errorf("the server is shutting down")
+		}
+		missing := u.unpreparedApps(cfg, prepared)
+		if len(missing) == 0 {
+			break
+		}
+		u.mu.Unlock()
+		for _, name := range missing {
+			app := cfg.Apps[name]
+			owner, repo := app.Repo()
+			if !fetch {
+				prepared[name] = u.newApp(name, owner, repo, &app.AppConfig, storage, cfg.RateLimit)
+				continue
+			}
+			p, err := u.prepare(name, owner, repo, &app.AppConfig, storage, cfg.RateLimit)
+			if err != nil {
+				stopPrepared()
+				return fmt.Errorf("Could not serve app %q: %v", name, err)
+			}
+			prepared[name] = p
+		}
+		u.mu.Lock()
+	}
+	defer u.mu.Unlock()
+
+	u.geoIP.Store(db)
+	u.SetTrustedProxies(trustedProxies)
+	u.rateLimit = cfg.RateLimit
+	u.patchStorage = storage
+	if previous != nil {
+		for name := range previous.Apps {
+			if _, ok := cfg.Apps[name]; ok {
+				continue
+			}
+			if name == "" {
+				delete(u.appConfigs, name)
+			} else if _, ok := u.apps[name]; ok {
+				_ = u.removeApp(name)
+			}
+		}
+	}
+	for name, app := range cfg.Apps {
+		u.appConfigs[name] = &app.AppConfig
+	}
+	for name, app := range prepared {
+		u.install(name, app)
+	}
+	for name, releaseManager := range u.apps {
+		if _, ok := prepared[name]; ok {
+			continue
+		}
+		releaseManager.SetDefaultRateLimit(cfg.RateLimit)
+		releaseManager.SetConfig(u.appConfig(name))
+	}
+	u.config = cfg
+	return nil
+}
+
+// unpreparedApps returns the names of the apps of cfg that are neither
+// prepared nor served from their configured source. u.mu must be held.
+func (u *UpdateServer) unpreparedApps(cfg *Config, prepared map[string]*preparedApp) []string {
+	var missing []string
+	for name, app := range cfg.Apps {
+		if _, ok := prepared[name]; ok {
+			continue
+		}
+		if rm, ok := u.apps[name]; ok && app.Source == rm.owner+"/"+rm.repo {
+			continue
+		}
+		if _, ok := u.apps[name]; ok {
+			log.Debugf("Source of app %q changed to %s", name, app.Source)
+		}
+		missing = append(missing, name)
+	}
+	return missing
+}
+
+// warnRestartRequired logs the settings changed from the previous
+// configuration that only take effect on restart. Each change is logged by
+// the reload making it only.
+func warnRestartRequired(previous *Config, cfg *Config) {
+	if cfg.PublicAddr != "" && cfg.PublicAddr != previous.PublicAddr {
+		log.Errorf("Public address changed to %s, restart to apply", cfg.PublicAddr)
+	}
+	if cfg.LocalAddr != "" && cfg.LocalAddr != previous.LocalAddr {
+		log.Errorf("Local address changed to %s, restart to apply", cfg.LocalAddr)
+	}
+	if cfg.PrivateKey != "" && cfg.PrivateKey != previous.PrivateKey {
+		log.Errorf("Private key changed to %s, restart to apply", cfg.PrivateKey)
+	}
+	if cfg.Storage != previous.Storage {
+		log.Errorf("Patch storage changed to %s, restart to apply", cfg.Storage.PatchStorage(cfg.PublicAddr).ID())
+	}
+	if !reflect.DeepEqual(cfg.Tracing, previous.Tracing) {
+		log.Errorf("Tracing settings changed, restart to apply")
+	}
+}
+
+// ReloadConfig reads a configuration file and applies it to the server.
+func (u *UpdateServer) ReloadConfig(file string) error {
+	cfg, err := LoadConfig(file)
+	if err != nil {
+		return err
+	}
+	return u.ApplyConfig(cfg)
+}
+
+// WatchConfig reloads the configuration file whenever it changes or a value
+// is received on reload, like SIGHUP, until the server is closed. Bad
+// configurations are logged and ignored.
+func (u *UpdateServer) WatchConfig(file string, reload <-chan os.Signal) {
+	modTime := func() time.Time {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}
+		}
+		return fi.ModTime()
+	}
+	lastModified := modTime()
+
+	tk := time.NewTicker(configPollInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			modified := modTime()
+			if modified.Equal(lastModified) {
+				continue
+			}
+			lastModified = modified
+			log.Debugf("Config %s changed, reloading", file)
+		case <-reload:
+			lastModified = modTime()
+			log.Debugf("Reloading config %s", file)
+		case <-u.chClose:
+			return
+		}
+		if err := u.ReloadConfig(file); err != nil {
+			log.Errorf("Keeping the current config: %v", err)
+		}
+	}
+}
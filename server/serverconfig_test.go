@@ -0,0 +1,169 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testYAMLConfig = `
+public_addr: https://update.example.com/
+private_key: ../_resources/example-keys/private.key
+rate_limit:
+  updates_per_second: 10
+storage:
+  type: s3
+  bucket: patches
+tracing:
+  endpoint: localhost:4317
+  protocol: grpc
+  insecure: true
+  sample_ratio: 0.25
+apps:
+  lantern:
+    source: getlantern/lantern
+    min_version: 6.0.0
+    rollouts:
+      - version: 7.1.0
+        percentage: 10
+    activations:
+      7.1.0: 2024-05-01T12:00:00Z
+  beam:
+    source: xiaoshoudian/xiazai
+`
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	cfg, err := LoadConfig(write("config.yaml", testYAMLConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lantern := cfg.Apps["lantern"]
+	if owner, repo := lantern.Repo(); owner != "getlantern" || repo != "lantern" {
+		t.Fatalf("Unexpected repo %s/%s", owner, repo)
+	}
+	if lantern.MinVersion != "6.0.0" || len(lantern.Rollouts) != 1 || lantern.Rollouts[0].Percentage != 10 {
+		t.Fatalf("Unexpected lantern settings %+v", lantern.AppConfig)
+	}
+	if !lantern.Activations["7.1.0"].Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected activations %v", lantern.Activations)
+	}
+	if cfg.RateLimit.UpdatesPerSecond != 10 || cfg.Storage.Bucket != "patches" || cfg.Apps["beam"].Source != "xiaoshoudian/xiazai" {
+		t.Fatalf("Unexpected config %+v", cfg)
+	}
+	if tracing := cfg.Tracing; tracing.Endpoint != "localhost:4317" || tracing.Protocol != "grpc" || !tracing.Insecure || *tracing.SampleRatio != 0.25 {
+		t.Fatalf("Unexpected tracing settings %+v", tracing)
+	}
+	if storage, ok := cfg.Storage.PatchStorage(cfg.PublicAddr).(*S3PatchStorage); !ok || storage.Region != "us-east-1" {
+		t.Fatalf("Unexpected patch storage %+v", storage)
+	}
+
+	if _, err = LoadConfig(write("config.json", `{"apps": {"lantern": {"source": "getlantern/lantern"}}}`)); err != nil {
+		t.Fatalf("Could not load JSON config: %v", err)
+	}
+
+	for name, content := range map[string]string{
+		"unknown field":   `{"apps": {"lantern": {"source": "getlantern/lantern", "min_versoin": "6.0.0"}}}`,
+		"bad source":      `{"apps": {"lantern": {"source": "lantern"}}}`,
+		"bad settings":    `{"apps": {"lantern": {"source": "getlantern/lantern", "min_version": "six"}}}`,
+		"bad storage":     `{"storage": {"type": "ftp"}, "apps": {}}`,
+		"missing bucket":  `{"storage": {"type": "s3"}, "apps": {}}`,
+		"bad rate limit":  `{"rate_limit": {"updates_per_second": -1}, "apps": {}}`,
+		"bad protocol":    `{"tracing": {"protocol": "udp"}, "apps": {}}`,
+		"bad ratio":       `{"tracing": {"sample_ratio": 2}, "apps": {}}`,
+		"not a json file": `apps: {}`,
+	} {
+		if _, err = LoadConfig(write("bad.json", content)); err == nil {
+			t.Errorf("Expecting config with %s to be rejected", name)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	rm := newTestReleaseManager(t)
+	asset := pushTestAsset(t, rm, OS.Linux, Arch.X64, "7.1.0")
+
+	u := NewUpdateServer("http://127.0.0.1:9999/", "127.0.0.1:0", ".", 0)
+	u.newReleaseManager = newTestReleaseManagers(t)
+	u.apps["lantern"] = rm
+	u.apps[""] = NewReleaseManager("getlantern", "lantern")
+	defer u.Close()
+
+	file := filepath.Join(t.TempDir(), "config.yml")
+	write := func(content string) {
+		// Replace the file at once so that reloads never read it half
+		// written.
+		if err := os.WriteFile(file+".tmp", []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(file+".tmp", file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(testYAMLConfig)
+
+	reload := make(chan os.Signal)
+	go u.WatchConfig(file, reload)
+	reload <- os.Interrupt
+	waitFor := func(cond func() bool) {
+		t.Helper()
+		for i := 0; i < 100 && !cond(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !cond() {
+			t.Fatal("Timed out waiting for the config to be applied")
+		}
+	}
+	waitFor(func() bool {
+		_, ok := u.app("beam")
+		return ok
+	})
+
+	if rm.Config().MinVersion != "6.0.0" {
+		t.Fatalf("Expecting the settings of lantern to be applied, got %+v", rm.Config())
+	}
+	if rm.RateLimit().UpdatesPerSecond != 10 {
+		t.Fatalf("Expecting the default rate limit to be applied, got %+v", rm.RateLimit())
+	}
+	if legacy, _ := u.app(""); legacy.Config().MinVersion != "6.0.0" {
+		t.Fatal("/update should get the settings of lantern")
+	}
+	if u.patchStorage.ID() != "local" {
+		t.Fatalf("Patch storage should not change while serving, got %s", u.patchStorage.ID())
+	}
+	if a, err := rm.lookupAssetWithVersion(OS.Linux, Arch.X64, "7.1.0"); err != nil || a != asset {
+		t.Fatalf("Assets should be kept across reloads, got %v, %v", a, err)
+	}
+	if beam, _ := u.app("beam"); beam.repo != "xiazai" {
+		t.Fatalf("Expecting beam to be served from its repo, got %s", beam.repo)
+	}
+
+	write(strings.Replace(testYAMLConfig, "min_version: 6.0.0", "min_version: six", 1))
+	reload <- os.Interrupt
+	write(strings.Replace(testYAMLConfig, "min_version: 6.0.0", "min_version: 6.1.0", 1))
+	reload <- os.Interrupt
+	waitFor(func() bool { return rm.Config().MinVersion == "6.1.0" })
+
+	if err := u.AddApp("flashlight", &App{Source: "getlantern/flashlight"}); err != nil {
+		t.Fatal(err)
+	}
+	write(strings.Replace(testYAMLConfig, "  beam:\n    source: xiaoshoudian/xiazai\n", "", 1))
+	reload <- os.Interrupt
+	waitFor(func() bool {
+		_, ok := u.app("beam")
+		return !ok
+	})
+	if _, ok := u.app("flashlight"); !ok {
+		t.Fatal("Apps added with the admin API should be kept across reloads")
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// listenAndServe serves srv until the server is shut down or closed.
+func (u *UpdateServer) listenAndServe(srv *http.Server) error {
+	u.mu.Lock()
+	if u.closing {
+		u.mu.Unlock()
+		return http.ErrServerClosed
+	}
+	u.servers = append(u.servers, srv)
+	u.mu.Unlock()
+	return srv.ListenAndServe()
+}
+
+// stopServing marks the server as closing, which stops the background
+// refreshes and the config watcher, and returns the HTTP servers and release
+// managers to stop, including the retired ones still handling requests.
+func (u *UpdateServer) stopServing() ([]*http.Server, []*ReleaseManager) {
+	u.closeOnce.Do(func() { close(u.chClose) })
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closing = true
+	servers := u.servers
+	u.servers = nil
+	releaseManagers := make([]*ReleaseManager, 0, len(u.apps)+len(u.retired))
+	for _, releaseManager := range u.apps {
+		releaseManagers = append(releaseManagers, releaseManager)
+	}
+	for releaseManager := range u.retired {
+		releaseManagers = append(releaseManagers, releaseManager)
+	}
+	return servers, releaseManagers
+}
+
+// Shutdown gracefully stops the server. It stops accepting connections and
+// waits for the requests being handled to complete, then cancels the
+// refreshes, downloads and patch generations still in progress, killing
+// bsdiff if need be, and waits for the background refreshes to return. If ctx
+// is done first, the remaining connections are closed and the work in progress
+// is cancelled right away. ListenAndServe and ListenAndServeAdmin return
+// http.ErrServerClosed once Shutdown is called.
+func (u *UpdateServer) Shutdown(ctx context.Context) error {
+	servers, releaseManagers := u.stopServing()
+
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, srv := range servers {
+		wg.Add(1)
+		go func(i int, srv *http.Server) {
+			defer wg.Done()
+			log.Debugf("Shutting down HTTP server at %s.", srv.Addr)
+			if err := srv.Shutdown(ctx); err != nil {
+				errs[i] = fmt.Errorf("Could not drain requests to %s: %v", srv.Addr, err)
+				_ = srv.Close()
+			}
+		}(i, srv)
+	}
+	wg.Wait()
+
+	for _, releaseManager := range releaseManagers {
+		releaseManager.Stop()
+	}
+	done := make(chan struct{})
+	go func() {
+		u.refreshes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("Background refreshes did not stop in time: %v", ctx.Err()))
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops the server right away, closing all connections and cancelling
+// the work in progress. See Shutdown to stop gracefully.
+func (u *UpdateServer) Close() {
+	servers, releaseManagers := u.stopServing()
+	for _, releaseManager := range releaseManagers {
+		releaseManager.Stop()
+	}
+	for _, srv := range servers {
+		log.Debugf("Closing HTTP server at %s.", srv.Addr)
+		_ = srv.Close()
+	}
+}
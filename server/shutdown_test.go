@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	u := NewUpdateServer("http://"+addr+"/", addr, ".", 0)
+	u.newReleaseManager = newTestReleaseManagers(t)
+	if err = u.AddApp("lantern", &App{Source: "getlantern/lantern"}); err != nil {
+		t.Fatal(err)
+	}
+	rm, _ := u.app("lantern")
+
+	started := make(chan struct{})
+	u.mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	})
+
+	served := make(chan error, 1)
+	go func() { served <- u.ListenAndServe() }()
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		res, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		responses <- response{string(b), err}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = u.Shutdown(ctx); err != nil {
+		t.Fatalf("Unexpected error shutting down: %v", err)
+	}
+	if res := <-responses; res.err != nil || res.body != "done" {
+		t.Fatalf("Expecting the request being handled to complete, got %q, %v", res.body, res.err)
+	}
+	if err = <-served; err != http.ErrServerClosed {
+		t.Fatalf("Expecting ListenAndServe to return ErrServerClosed, got %v", err)
+	}
+	if rm.ctx.Err() == nil {
+		t.Fatal("Expecting the work of release managers to be cancelled")
+	}
+	if err = u.ListenAndServe(); err != http.ErrServerClosed {
+		t.Fatalf("Expecting a shut down server not to serve again, got %v", err)
+	}
+	if err = u.AddApp("beam", &App{Source: "xiaoshoudian/xiazai"}); err == nil {
+		t.Fatal("Expecting apps not to be added once shut down")
+	}
+	u.Close()
+}
+
+func TestCancelPatchGeneration(t *testing.T) {
+	for _, name := range []string{"_tests/file-a", "_tests/file-b"} {
+		if err := writeFile(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := bsdiff(ctx, "_tests/file-a", "_tests/file-b"); err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("Expecting patch generation to be cancelled, got %v", err)
+	}
+	if err := acquirePatchSlot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	err := acquirePatchSlot(ctx)
+	releasePatchSlot()
+	if err == nil {
+		t.Fatal("Expecting waiting for a patch slot to be cancelled")
+	}
+	t.Setenv(envSkipDownload, "false")
+	if _, err := downloadAsset(ctx, "https://github.com/getlantern/lantern/releases/download/7.1.0/cancelled"); err == nil {
+		t.Fatal("Expecting download to be cancelled")
+	}
+}
@@ -28,6 +28,14 @@ func SetPrivateKey(s string) {
 	}
 }
 
+// privateKeyPath returns the path of the key updates and responses are signed
+// with.
+func privateKeyPath() string {
+	rsaPrivateKeyMu.Lock()
+	defer rsaPrivateKeyMu.Unlock()
+	return privateKeyFile
+}
+
 func checksumForFile(file string) (checksumHex string, err error) {
 	var checksum []byte
 	if checksum, err = update.ChecksumForFile(file); err != nil {
@@ -51,11 +59,22 @@ func privateKey() (*rsa.PrivateKey, error) {
 		log.Fatalf("Missing private key, forgot to call SetPrivateKey()?")
 	}
 
+	rsaPrivateKey, err = readPrivateKey(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return rsaPrivateKey, nil
+}
+
+func readPrivateKey(file string) (*rsa.PrivateKey, error) {
+	var err error
+
 	// Loading private key
 	var pb []byte
 	var fpk *os.File
 
-	if fpk, err = os.Open(privateKeyFile); err != nil {
+	if fpk, err = os.Open(file); err != nil {
 		return nil, fmt.Errorf("Could not open private key: %q", err)
 	}
 	defer fpk.Close()
@@ -66,13 +85,11 @@ func privateKey() (*rsa.PrivateKey, error) {
 
 	// Decoding PEM key.
 	pemBlock, _ := pem.Decode(pb)
-
-	rsaPrivateKey, err = x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
-	if err != nil {
-		return nil, err
+	if pemBlock == nil {
+		return nil, fmt.Errorf("Could not decode private key %s", file)
 	}
 
-	return rsaPrivateKey, nil
+	return x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
 }
 
 // Sign creates a signatures for a byte array.
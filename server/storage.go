@@ -0,0 +1,39 @@
+package server
+
+import "context"
+
+// PatchStorage is where generated patches are published for clients to
+// download them.
+type PatchStorage interface {
+	// ID identifies the storage, it's recorded along with each patch so that
+	// patches are published again if the storage changes.
+	ID() string
+	// Put publishes the given local patch file under name. It gives up once
+	// ctx is done.
+	Put(ctx context.Context, name string, file string) error
+	// URL returns the address clients should download the patch from.
+	URL(name string) (string, error)
+}
+
+// LocalPatchStorage serves patches from the patches directory through the
+// /patches/ endpoint of the update server.
+type LocalPatchStorage struct {
+	// PublicAddr is the public address of the update server.
+	PublicAddr string
+}
+
+// ID implements PatchStorage.
+func (l *LocalPatchStorage) ID() string {
+	return "local"
+}
+
+// Put implements PatchStorage. Patches are generated right into the patches
+// directory, so there is nothing to do.
+func (l *LocalPatchStorage) Put(ctx context.Context, name string, file string) error {
+	return nil
+}
+
+// URL implements PatchStorage.
+func (l *LocalPatchStorage) URL(name string) (string, error) {
+	return l.PublicAddr + patchesDirectory + name, nil
+}
@@ -1,12 +1,13 @@
 package server
 
-import "context"
+import "strconv"
 
-const userIDKey = "UserId"
-
-func userIDFromRequest(c context.Context) int64 {
-	if id := c.Value(userIDKey); id != nil {
-		return id.(int64)
+// numericUserID returns the Lantern user ID sent by the client as a number, 0
+// if there is none.
+func numericUserID(userID string) int64 {
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return 0
 	}
-	return 0
+	return id
 }